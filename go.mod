@@ -7,6 +7,8 @@ require (
 	github.com/ajstarks/svgo v0.0.0-20200204031535-0cbcf57ea1d8 // indirect
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/jung-kurt/gofpdf v1.16.2 // indirect
+	github.com/klauspost/compress v1.11.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/image v0.0.0-20200119044424-58c23975cae1 // indirect
 	gonum.org/v1/netlib v0.0.0-20191229114700-bbb4dff026f8 // indirect
 	gonum.org/v1/plot v0.7.0
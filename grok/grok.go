@@ -0,0 +1,244 @@
+// Package grok implements grok expressions, as used by logstash,
+// on top of Go regular expressions.
+//
+// Expressions reference named patterns with %{PATTERN} and capture
+// the matched text in a field with %{PATTERN:field}. A type suffix
+// (%{PATTERN:field:int}) is accepted and ignored: all values are strings.
+// Patterns are Go (RE2) regular expressions, atomic groups (?>...) found in
+// logstash pattern files are turned into plain groups, lookarounds are not
+// supported.
+package grok
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type (
+	// Grok holds a library of named patterns
+	Grok struct {
+		patterns map[string]string
+	}
+
+	// Pattern is a compiled grok expression
+	Pattern struct {
+		re *regexp.Regexp
+		// field names indexed by capture group, "" for unnamed groups
+		fields []string
+	}
+
+	// Patterns are tried in order, the first one to match wins
+	Patterns []*Pattern
+)
+
+var (
+	// %{NAME}, %{NAME:field} or %{NAME:field:type}
+	reference = regexp.MustCompile(`%\{(\w+)(?::([^:}]+))?(?::\w+)?\}`)
+	// Oniguruma named groups
+	onigurumaGroup = regexp.MustCompile(`\(\?<([A-Za-z]\w*)>`)
+	// Maximum nesting of pattern references
+	maxDepth = 64
+)
+
+// New returns a Grok loaded with the base pattern library
+func New() *Grok {
+	g := &Grok{patterns: make(map[string]string)}
+	for k, v := range basePatterns {
+		g.patterns[k] = v
+	}
+	return g
+}
+
+// AddPattern adds or replaces a named pattern
+func (g *Grok) AddPattern(name string, expr string) {
+	g.patterns[name] = strings.Replace(expr, "(?>", "(?:", -1)
+}
+
+// AddPatterns reads pattern definitions from r, one "NAME expression"
+// per line as in logstash pattern files. Blank lines and lines
+// starting with # are ignored
+func (g *Grok) AddPatterns(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		i := strings.IndexAny(l, " \t")
+		if i < 0 {
+			return fmt.Errorf("line %v: missing expression for pattern %v", n, l)
+		}
+		g.AddPattern(l[:i], strings.TrimSpace(l[i+1:]))
+	}
+	return scanner.Err()
+}
+
+// AddPatternsFromFile reads pattern definitions from a file
+func (g *Grok) AddPatternsFromFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := g.AddPatterns(f); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+// AddPatternsFromDir reads pattern definitions from every file of dir,
+// in lexical order. A missing dir is not an error
+func (g *Grok) AddPatternsFromDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if err := g.AddPatternsFromFile(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compile compiles a grok expression
+func (g *Grok) Compile(expr string) (*Pattern, error) {
+	p := &Pattern{}
+	// Capture groups get generated names, field names
+	// are not restricted to Go identifiers
+	captures := make(map[string]string)
+	expanded, err := g.expand(expr, captures, 0)
+	if err != nil {
+		return nil, err
+	}
+	p.re, err = regexp.Compile(expanded)
+	if err != nil {
+		return nil, err
+	}
+	p.fields = make([]string, len(p.re.SubexpNames()))
+	for i, n := range p.re.SubexpNames() {
+		if f, ok := captures[n]; ok {
+			p.fields[i] = f
+		} else {
+			// (?P<name>...) groups written in Go syntax
+			p.fields[i] = n
+		}
+	}
+	return p, nil
+}
+
+// CompileFile compiles the grok expressions of a file, one per line.
+// Blank lines and lines starting with # are ignored
+func (g *Grok) CompileFile(path string) (Patterns, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ps Patterns
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		p, err := g.Compile(l)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, n, err)
+		}
+		ps = append(ps, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("%v: no grok expression", path)
+	}
+	return ps, nil
+}
+
+// expand replaces pattern references by their expression,
+// recording the generated capture group names in captures
+func (g *Grok) expand(expr string, captures map[string]string, depth int) (string, error) {
+	if depth > maxDepth {
+		return "", fmt.Errorf("pattern nesting too deep, is there a loop?")
+	}
+	expr = onigurumaGroup.ReplaceAllStringFunc(expr, func(m string) string {
+		name := onigurumaGroup.FindStringSubmatch(m)[1]
+		gname := fmt.Sprintf("grok%d", len(captures))
+		captures[gname] = name
+		return "(?P<" + gname + ">"
+	})
+
+	var err error
+	res := reference.ReplaceAllStringFunc(expr, func(m string) string {
+		if err != nil {
+			return ""
+		}
+		sm := reference.FindStringSubmatch(m)
+		def, ok := g.patterns[sm[1]]
+		if !ok {
+			err = fmt.Errorf("unknown pattern %v", sm[1])
+			return ""
+		}
+		// Reserve the group name before expanding nested references
+		gname := ""
+		if sm[2] != "" {
+			gname = fmt.Sprintf("grok%d", len(captures))
+			captures[gname] = sm[2]
+		}
+		sub, e := g.expand(def, captures, depth+1)
+		if e != nil {
+			err = e
+			return ""
+		}
+		if gname == "" {
+			return "(?:" + sub + ")"
+		}
+		return "(?P<" + gname + ">" + sub + ")"
+	})
+	return res, err
+}
+
+// Match returns the fields captured in line, nil if it does not match
+func (p *Pattern) Match(line []byte) map[string]string {
+	m := p.re.FindSubmatchIndex(line)
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]string)
+	for i, f := range p.fields {
+		if f == "" || m[2*i] < 0 {
+			continue
+		}
+		res[f] = string(line[m[2*i]:m[2*i+1]])
+	}
+	return res
+}
+
+// Match returns the fields captured by the first pattern to match line,
+// nil if none does
+func (ps Patterns) Match(line []byte) map[string]string {
+	for _, p := range ps {
+		if res := p.Match(line); res != nil {
+			return res
+		}
+	}
+	return nil
+}
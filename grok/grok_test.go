@@ -0,0 +1,139 @@
+package grok
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	g := New()
+	if err := g.AddPatterns(strings.NewReader(`
+# Custom patterns, atomic groups become plain groups
+SSHUSER (?>%{USERNAME}|)
+SSHINVALID Invalid user %{SSHUSER:username} from %{IP:src}
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		expr    string
+		line    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "syslog base",
+			expr: `%{SYSLOGBASE} %{GREEDYDATA:message}`,
+			line: "Jan  5 06:25:44 host sshd[1234]: Accepted publickey for git",
+			want: map[string]string{"timestamp": "Jan  5 06:25:44", "logsource": "host", "program": "sshd", "pid": "1234", "message": "Accepted publickey for git"},
+		},
+		{
+			name: "custom patterns",
+			expr: `%{SSHINVALID}`,
+			line: "Invalid user admin from 1.2.3.4 port 22",
+			want: map[string]string{"username": "admin", "src": "1.2.3.4"},
+		},
+		{
+			name: "empty capture",
+			expr: `%{SSHINVALID}`,
+			line: "Invalid user  from 2001:db8::1",
+			want: map[string]string{"username": "", "src": "2001:db8::1"},
+		},
+		{
+			name: "type suffix",
+			expr: `port %{POSINT:port:int}`,
+			line: "from 1.2.3.4 port 22 ssh2",
+			want: map[string]string{"port": "22"},
+		},
+		{
+			name: "field names beyond identifiers",
+			expr: `%{IP:[client][ip]} %{WORD:user.name}`,
+			line: "5.6.7.8 root",
+			want: map[string]string{"[client][ip]": "5.6.7.8", "user.name": "root"},
+		},
+		{
+			name: "oniguruma and Go named groups",
+			expr: `(?<queue>[0-9A-F]+): client=(?P<client>\S+)`,
+			line: "4F2E51C0A3: client=unknown[1.2.3.4]",
+			want: map[string]string{"queue": "4F2E51C0A3", "client": "unknown[1.2.3.4]"},
+		},
+		{
+			name: "optional group not matched",
+			expr: `%{SYSLOGPROG}: hello`,
+			line: "cron: hello",
+			want: map[string]string{"program": "cron"},
+		},
+		{
+			name: "no match",
+			expr: `%{SSHINVALID}`,
+			line: "Accepted publickey for git from 1.2.3.4",
+		},
+		{
+			name:    "unknown pattern",
+			expr:    `%{NOPE:x}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid regular expression",
+			expr:    `%{WORD:x}(`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := g.Compile(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := p.Match([]byte(tt.line)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileLoop(t *testing.T) {
+	g := New()
+	g.AddPattern("A", "%{B}")
+	g.AddPattern("B", "%{A}")
+	if _, err := g.Compile("%{A}"); err == nil {
+		t.Error("Compile() of a pattern loop should fail")
+	}
+}
+
+func TestAddPatternsMissingExpression(t *testing.T) {
+	g := New()
+	if err := g.AddPatterns(strings.NewReader("GOOD \\d+\nBAD\n")); err == nil {
+		t.Error("AddPatterns() of a pattern without expression should fail")
+	}
+}
+
+func TestPatternsFirstMatchWins(t *testing.T) {
+	g := New()
+	var ps Patterns
+	for _, expr := range []string{`user %{WORD:first}`, `%{WORD:second} %{WORD:third}`} {
+		p, err := g.Compile(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps = append(ps, p)
+	}
+	tests := []struct {
+		line string
+		want map[string]string
+	}{
+		{"user root", map[string]string{"first": "root"}},
+		{"group wheel", map[string]string{"second": "group", "third": "wheel"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := ps.Match([]byte(tt.line)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
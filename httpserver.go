@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/D4-project/analyzer-d4-log/logcompiler"
+)
+
+// Maximum number of members returned by /pairs/
+const maxPairs = 1000
+
+// serveHTTP serves the HTML output found in data/, the date
+// ranges of the compilers under /range/<name>?from=&to=&type=
+// and the pairs of a value under /pairs/<name>?day=&dimension=&value=&n=
+func serveHTTP(addr string, compilers map[string]logcompiler.Compiler) {
+	mux := http.NewServeMux()
+	mux.Handle("/data/", http.StripPrefix("/data/", http.FileServer(http.Dir("data"))))
+	mux.HandleFunc("/range/", func(w http.ResponseWriter, req *http.Request) {
+		c, ok := compilers[strings.TrimPrefix(req.URL.Path, "/range/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		q := req.URL.Query()
+		var b bytes.Buffer
+		if err := c.PlotRange(q.Get("from"), q.Get("to"), q.Get("type"), &b); err != nil {
+			log.Printf("Range %v: %v", req.URL, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(b.Bytes())
+	})
+
+	mux.HandleFunc("/pairs/", func(w http.ResponseWriter, req *http.Request) {
+		c, ok := compilers[strings.TrimPrefix(req.URL.Path, "/pairs/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		q := req.URL.Query()
+		n, err := strconv.Atoi(q.Get("n"))
+		if err != nil || n <= 0 || n > maxPairs {
+			n = maxPairs
+		}
+		with, err := c.Pairs(q.Get("day"), q.Get("dimension"), q.Get("value"), n)
+		if err != nil {
+			log.Printf("Pairs %v: %v", req.URL, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(with)
+	})
+
+	log.Printf("Serving statistics on http://%v/data/", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
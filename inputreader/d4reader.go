@@ -0,0 +1,174 @@
+package inputreader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/D4-project/d4-golang-utils/crypto/hash"
+	"github.com/gomodule/redigo/redis"
+)
+
+// D4AnalyzerReader consumes the analyzer queue of a d4-server,
+// it registers itself as an analyzer of the given type and
+// behaves like a reader.
+//
+// Queued items are resolved as follows:
+//   - paths to files stored by d4-server are read line by line, the
+//     sensor UUID is the path element that parses as a UUID,
+//   - "<sensor uuid>:<logline>" items are split,
+//   - anything else is a logline from an unknown sensor.
+type D4AnalyzerReader struct {
+	// D4 redis connection
+	r *redis.Conn
+	// D4 redis database
+	d int
+	// Analyzer UUID
+	uuid string
+	// D4 Queue storing
+	q string
+	// File being read and its sensor
+	f      *os.File
+	lines  *bufio.Reader
+	sensor string
+	// Current buffer, for Read
+	buf []byte
+}
+
+// NewD4AnalyzerReader registers analyzer uuid for type t
+// on the d4-server redis and returns a reader on its queue
+func NewD4AnalyzerReader(rc *redis.Conn, db int, t int, uuid string, description string) (*D4AnalyzerReader, error) {
+	rr := *rc
+
+	if _, err := hash.FromString(uuid); err != nil {
+		return nil, fmt.Errorf("invalid analyzer uuid %q: %v", uuid, err)
+	}
+
+	if _, err := rr.Do("SELECT", db); err != nil {
+		rr.Close()
+		return nil, err
+	}
+
+	// Registering, d4-server pushes type t data to every analyzer of this set
+	if _, err := rr.Do("SADD", fmt.Sprintf("analyzer:%d", t), uuid); err != nil {
+		rr.Close()
+		return nil, err
+	}
+	if _, err := rr.Do("HSETNX", fmt.Sprintf("analyzer:%v", uuid), "description", description); err != nil {
+		rr.Close()
+		return nil, err
+	}
+
+	return &D4AnalyzerReader{
+		r:    rc,
+		d:    db,
+		uuid: uuid,
+		q:    fmt.Sprintf("analyzer:%d:%v", t, uuid),
+	}, nil
+}
+
+// ReadLine returns the next logline with its sensor,
+// io.EOF when the queue is empty
+func (dr *D4AnalyzerReader) ReadLine() (*Line, error) {
+	for {
+		// Lines of the file being read first
+		if dr.lines != nil {
+			b, err := dr.lines.ReadBytes('\n')
+			if len(b) > 0 && (err == nil || err == io.EOF) {
+				return &Line{Data: bytes.TrimRight(b, "\r\n"), Sensor: dr.sensor, Source: dr.f.Name()}, nil
+			}
+			if err != io.EOF {
+				log.Printf("Error reading %v: %v", dr.f.Name(), err)
+			}
+			dr.closeFile()
+		}
+
+		rr := *dr.r
+		item, err := redis.Bytes(rr.Do("LPOP", dr.q))
+		// If redis return empty: EOF (user should not stop)
+		if err == redis.ErrNil {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+
+		if path := string(bytes.TrimSpace(item)); filepath.IsAbs(path) {
+			if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+				if err := dr.openFile(path); err != nil {
+					log.Printf("Error opening %v: %v", path, err)
+				}
+				continue
+			}
+		}
+
+		l := &Line{Data: bytes.TrimRight(item, "\r\n"), Source: dr.q}
+		if i := bytes.IndexByte(item, ':'); i == 36 {
+			if _, err := hash.FromString(string(item[:i])); err == nil {
+				l.Sensor = string(item[:i])
+				l.Data = l.Data[i+1:]
+			}
+		}
+		return l, nil
+	}
+}
+
+// Read copies the next logline in p, each line
+// is terminated by a newline
+func (dr *D4AnalyzerReader) Read(p []byte) (n int, err error) {
+	if len(dr.buf) == 0 {
+		l, err := dr.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		dr.buf = append(l.Data, '\n')
+	}
+	n = copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+// openFile opens a file stored by d4-server, transparently
+// decompressing gzip files
+func (dr *D4AnalyzerReader) openFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	dr.f = f
+	dr.lines = bufio.NewReader(f)
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			dr.f, dr.lines = nil, nil
+			return err
+		}
+		dr.lines = bufio.NewReader(gz)
+	}
+	dr.sensor = ""
+	for _, e := range strings.Split(filepath.ToSlash(path), "/") {
+		if _, err := hash.FromString(e); err == nil && len(e) == 36 {
+			dr.sensor = e
+		}
+	}
+	return nil
+}
+
+func (dr *D4AnalyzerReader) closeFile() {
+	if dr.f != nil {
+		dr.f.Close()
+	}
+	dr.f, dr.lines, dr.sensor = nil, nil, ""
+}
+
+// Teardown is called on error to close the redis connection
+func (dr *D4AnalyzerReader) Teardown() {
+	dr.closeFile()
+	(*dr.r).Close()
+}
@@ -0,0 +1,216 @@
+package inputreader
+
+import (
+	"io"
+	"reflect"
+	"time"
+)
+
+type (
+	// FanInReader reads several sources concurrently, taking their lines
+	// in turn so that a backlogged source does not starve the others.
+	// Each line is tagged with the name of its source
+	FanInReader struct {
+		sources []*fanInSource
+		// Next source to take a line from
+		next int
+		// Select cases on the sources, and a timeout
+		cases []reflect.SelectCase
+		// Current buffer, for Read
+		buf []byte
+	}
+
+	// fanInSource reads a source in its own goroutine, one line ahead
+	// of ReadLine. The goroutine also acknowledges the lines, so that
+	// the source is never used by two goroutines at once
+	fanInSource struct {
+		name  string
+		r     LineReader
+		retry time.Duration
+		lines chan fanInLine
+		// Number of lines to acknowledge, and the result
+		acks  chan int
+		acked chan error
+		// Lines returned by ReadLine and not yet acknowledged
+		unacked int
+	}
+
+	fanInLine struct {
+		l   *Line
+		err error
+	}
+)
+
+// How long ReadLine waits for a line before returning io.EOF
+const fanInWait = 5 * time.Second
+
+// NewFanInReader reads readers, named after names. Sources that do
+// not wait for data themselves are polled every retry once drained
+func NewFanInReader(names []string, readers []LineReader, retry time.Duration) *FanInReader {
+	fr := &FanInReader{}
+	for i, r := range readers {
+		s := &fanInSource{
+			name:  names[i],
+			r:     r,
+			retry: retry,
+			lines: make(chan fanInLine),
+			acks:  make(chan int, 1),
+			acked: make(chan error),
+		}
+		fr.sources = append(fr.sources, s)
+		fr.cases = append(fr.cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.lines)})
+		go s.run()
+	}
+	// Timeout, set by ReadLine
+	fr.cases = append(fr.cases, reflect.SelectCase{Dir: reflect.SelectRecv})
+	return fr
+}
+
+func (s *fanInSource) run() {
+	b, ok := s.r.(Blocking)
+	blocking := ok && b.Blocking()
+	// Lines sent and not yet acknowledged
+	pending := 0
+	for {
+		l, err := s.r.ReadLine()
+		if err == io.EOF {
+			// Sources that waited already read again at once, unless
+			// they may be waiting for their lines to be acknowledged
+			if blocking && pending == 0 {
+				continue
+			}
+			select {
+			case n := <-s.acks:
+				pending -= n
+				s.acked <- s.ack(n)
+			case <-time.After(s.retry):
+			}
+			continue
+		}
+		if l != nil {
+			l.Source = s.name
+		}
+		// Acknowledging while waiting for the line to be taken, the
+		// lines acknowledged were returned before it
+		for sent := false; !sent; {
+			select {
+			case s.lines <- fanInLine{l, err}:
+				sent = true
+			case n := <-s.acks:
+				pending -= n
+				s.acked <- s.ack(n)
+			}
+		}
+		if err == nil {
+			pending++
+		}
+		if err != nil {
+			// Done, the lines returned may still be acknowledged
+			for n := range s.acks {
+				s.acked <- s.ack(n)
+			}
+			return
+		}
+	}
+}
+
+// ack acknowledges the first n lines returned by the source. Other
+// acknowledgers also acknowledge the line read ahead, which is
+// then lost if the analyzer stops before it is processed
+func (s *fanInSource) ack(n int) error {
+	switch a := s.r.(type) {
+	case partialAcknowledger:
+		return a.ackFirst(n)
+	case Acknowledger:
+		return a.Ack()
+	}
+	return nil
+}
+
+// ReadLine returns the next line, taking the sources in turn,
+// io.EOF when none had a line for some time
+func (fr *FanInReader) ReadLine() (*Line, error) {
+	if len(fr.sources) == 0 {
+		return nil, io.EOF
+	}
+
+	// Round robin on the sources with a line ready
+	for i := range fr.sources {
+		s := fr.sources[(fr.next+i)%len(fr.sources)]
+		select {
+		case fl := <-s.lines:
+			fr.next = (fr.next + i + 1) % len(fr.sources)
+			return fr.received(s, fl)
+		default:
+		}
+	}
+
+	// Then wait for the first one
+	fr.cases[len(fr.sources)].Chan = reflect.ValueOf(time.After(fanInWait))
+	i, v, _ := reflect.Select(fr.cases)
+	if i == len(fr.sources) {
+		return nil, io.EOF
+	}
+	fr.next = (i + 1) % len(fr.sources)
+	return fr.received(fr.sources[i], v.Interface().(fanInLine))
+}
+
+func (fr *FanInReader) received(s *fanInSource, fl fanInLine) (*Line, error) {
+	if fl.err != nil {
+		return nil, fl.err
+	}
+	s.unacked++
+	return fl.l, nil
+}
+
+// Ack acknowledges the lines returned to their sources,
+// which are told all at once in case they are waiting
+func (fr *FanInReader) Ack() error {
+	var told []*fanInSource
+	for _, s := range fr.sources {
+		if s.unacked > 0 {
+			s.acks <- s.unacked
+			s.unacked = 0
+			told = append(told, s)
+		}
+	}
+	var err error
+	for _, s := range told {
+		if e := <-s.acked; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Blocking tells the reader waits for new lines itself
+func (fr *FanInReader) Blocking() bool {
+	return true
+}
+
+// Read copies the next line in p, each line is terminated
+// by a newline. Lines are acknowledged once read
+func (fr *FanInReader) Read(p []byte) (n int, err error) {
+	if len(fr.buf) == 0 {
+		l, err := fr.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		if err := fr.Ack(); err != nil {
+			return 0, err
+		}
+		fr.buf = append(l.Data, '\n')
+	}
+	n = copy(p, fr.buf)
+	fr.buf = fr.buf[n:]
+	return n, nil
+}
+
+// Teardown is called on error to teardown the sources
+func (fr *FanInReader) Teardown() {
+	for _, s := range fr.sources {
+		if t, ok := s.r.(interface{ Teardown() }); ok {
+			t.Teardown()
+		}
+	}
+}
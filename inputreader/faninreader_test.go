@@ -0,0 +1,151 @@
+package inputreader
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sliceReader returns its lines, then io.EOF, and counts
+// the lines acknowledged
+type sliceReader struct {
+	sync.Mutex
+	lines []string
+	acks  int
+}
+
+func (r *sliceReader) ReadLine() (*Line, error) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.lines) == 0 {
+		return nil, io.EOF
+	}
+	l := &Line{Data: []byte(r.lines[0])}
+	r.lines = r.lines[1:]
+	return l, nil
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (r *sliceReader) ackFirst(n int) error {
+	r.Lock()
+	defer r.Unlock()
+	r.acks += n
+	return nil
+}
+
+func (r *sliceReader) Ack() error {
+	return fmt.Errorf("read ahead lines acknowledged")
+}
+
+func (r *sliceReader) acked() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.acks
+}
+
+func TestFanInReader(t *testing.T) {
+	a := &sliceReader{lines: []string{"a1", "a2", "a3"}}
+	b := &sliceReader{lines: []string{"b1"}}
+	fr := NewFanInReader([]string{"auth", "mail"}, []LineReader{a, b}, time.Millisecond)
+
+	// Lines are tagged with their source, whatever the order they come in
+	got := map[string][]string{}
+	for i := 0; i < 4; i++ {
+		l, err := fr.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[l.Source] = append(got[l.Source], string(l.Data))
+	}
+	want := map[string][]string{"auth": {"a1", "a2", "a3"}, "mail": {"b1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %v, want %v", got, want)
+	}
+
+	// Lines are acknowledged by Ack only, to their sources
+	if n := a.acked() + b.acked(); n != 0 {
+		t.Errorf("%v lines acknowledged, want 0", n)
+	}
+	if err := fr.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if a.acked() != 3 || b.acked() != 1 {
+		t.Errorf("acks = %v, %v, want 3, 1", a.acked(), b.acked())
+	}
+}
+
+func TestFanInReaderReadAhead(t *testing.T) {
+	a := &sliceReader{lines: []string{"a1", "a2", "a3"}}
+	fr := NewFanInReader([]string{"auth"}, []LineReader{a}, time.Millisecond)
+
+	// The lines read ahead are not acknowledged
+	for i := 0; i < 2; i++ {
+		if _, err := fr.ReadLine(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fr.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if a.acked() != 2 {
+		t.Errorf("%v lines acknowledged, want 2", a.acked())
+	}
+	if err := fr.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if a.acked() != 2 {
+		t.Errorf("%v lines acknowledged twice, want 2", a.acked())
+	}
+
+	// Then the last one, the source being drained
+	if _, err := fr.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fr.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if a.acked() != 3 {
+		t.Errorf("%v lines acknowledged, want 3", a.acked())
+	}
+}
+
+// blockingReader is a sliceReader waiting for lines itself
+type blockingReader struct {
+	*sliceReader
+}
+
+func (r blockingReader) Blocking() bool {
+	return true
+}
+
+func TestFanInReaderBlocking(t *testing.T) {
+	a := blockingReader{&sliceReader{}}
+	fr := NewFanInReader([]string{"auth"}, []LineReader{a}, time.Hour)
+
+	// Read again at once, without waiting for retry
+	time.Sleep(10 * time.Millisecond)
+	a.Lock()
+	a.lines = append(a.lines, "a1")
+	a.Unlock()
+	l, err := fr.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(l.Data) != "a1" {
+		t.Errorf("line = %q, want a1", l.Data)
+	}
+
+	// Acknowledged while waiting for new lines
+	if err := fr.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if a.acked() != 1 {
+		t.Errorf("%v lines acknowledged, want 1", a.acked())
+	}
+}
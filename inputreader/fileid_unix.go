@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package inputreader
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the inode of a file
+func fileID(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Ino), true
+}
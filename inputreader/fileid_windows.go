@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package inputreader
+
+import (
+	"os"
+)
+
+// fileID is not available on windows, checkpoints are not resumed
+func fileID(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,245 @@
+package inputreader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type (
+	// FilesReader reads a set of log files one after the other, oldest
+	// first, transparently decompressing gzip, bzip2 and zstd files
+	FilesReader struct {
+		files []string
+		// Index of the file being read
+		i int
+		// File being read
+		f     *os.File
+		close func()
+		lines *bufio.Reader
+		n     int
+		mtime time.Time
+		// Current buffer, for Read
+		buf []byte
+	}
+
+	// logFile is a file to read along with what orders it
+	logFile struct {
+		path string
+		// Name without compression nor rotation suffixes
+		base string
+		// Rotation number, 0 for the live file
+		rotation int
+		mtime    int64
+	}
+)
+
+var (
+	// Compression suffixes
+	compressed = regexp.MustCompile(`\.(gz|bz2|zst)$`)
+	// Rotation number suffix, as in auth.log.3
+	rotation = regexp.MustCompile(`\.(\d+)$`)
+	// Magic numbers
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// NewFilesReader reads the files matching pattern, which is a file,
+// a glob pattern or a directory whose files are all read.
+//
+// Files rotated from a same log (auth.log, auth.log.1, auth.log.2.gz...)
+// are read from the highest rotation number to the live file, logs are
+// ordered by the modification time of their oldest file
+func NewFilesReader(pattern string) (*FilesReader, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no file matches %v", pattern)
+	}
+
+	var files []logFile
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, newLogFile(p, fi))
+			continue
+		}
+		err = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+				files = append(files, newLogFile(path, info))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The oldest file of each log orders the logs
+	oldest := make(map[string]int64)
+	for _, f := range files {
+		if t, ok := oldest[f.base]; !ok || f.mtime < t {
+			oldest[f.base] = f.mtime
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.base != b.base {
+			if oldest[a.base] != oldest[b.base] {
+				return oldest[a.base] < oldest[b.base]
+			}
+			return a.base < b.base
+		}
+		if a.rotation != b.rotation {
+			// The live file is the newest
+			if a.rotation == 0 || b.rotation == 0 {
+				return b.rotation == 0
+			}
+			return a.rotation > b.rotation
+		}
+		return a.path < b.path
+	})
+
+	fr := &FilesReader{i: -1}
+	for _, f := range files {
+		fr.files = append(fr.files, f.path)
+	}
+	return fr, nil
+}
+
+func newLogFile(path string, fi os.FileInfo) logFile {
+	f := logFile{path: path, mtime: fi.ModTime().UnixNano()}
+	f.base = compressed.ReplaceAllString(path, "")
+	if m := rotation.FindStringSubmatch(f.base); m != nil {
+		f.rotation, _ = strconv.Atoi(m[1])
+		f.base = strings.TrimSuffix(f.base, m[0])
+	}
+	return f
+}
+
+// Files returns the files to read, in reading order
+func (fr *FilesReader) Files() []string {
+	return fr.files
+}
+
+// ReadLine returns the next line, io.EOF once every file has been read
+func (fr *FilesReader) ReadLine() (*Line, error) {
+	for {
+		if fr.lines != nil {
+			b, err := fr.lines.ReadBytes('\n')
+			if len(b) > 0 && (err == nil || err == io.EOF) {
+				fr.n++
+				return &Line{Data: bytes.TrimRight(b, "\r\n"), Source: fr.files[fr.i], Modified: fr.mtime}, nil
+			}
+			if err != io.EOF {
+				log.Printf("Error reading %v: %v", fr.files[fr.i], err)
+			}
+			log.Printf("[%v/%v] %v done, %v lines", fr.i+1, len(fr.files), fr.files[fr.i], fr.n)
+			fr.closeFile()
+		}
+
+		if fr.i+1 >= len(fr.files) {
+			return nil, io.EOF
+		}
+		fr.i++
+		if err := fr.openFile(fr.files[fr.i]); err != nil {
+			log.Printf("[%v/%v] Error opening %v: %v", fr.i+1, len(fr.files), fr.files[fr.i], err)
+			continue
+		}
+		log.Printf("[%v/%v] Reading %v", fr.i+1, len(fr.files), fr.files[fr.i])
+	}
+}
+
+// Read copies the next line in p, each line
+// is terminated by a newline
+func (fr *FilesReader) Read(p []byte) (n int, err error) {
+	if len(fr.buf) == 0 {
+		l, err := fr.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		fr.buf = append(l.Data, '\n')
+	}
+	n = copy(p, fr.buf)
+	fr.buf = fr.buf[n:]
+	return n, nil
+}
+
+// openFile opens path, the compression is found
+// from the first bytes of the file
+func (fr *FilesReader) openFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+
+	var r io.Reader = br
+	fr.close = func() {}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		r = gz
+	case bytes.HasPrefix(magic, bzip2Magic):
+		r = bzip2.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		r = zr
+		fr.close = zr.Close
+	}
+	fr.f = f
+	fr.lines = bufio.NewReader(r)
+	fr.n = 0
+	fr.mtime = fi.ModTime()
+	return nil
+}
+
+func (fr *FilesReader) closeFile() {
+	if fr.f != nil {
+		fr.close()
+		fr.f.Close()
+	}
+	fr.f, fr.lines = nil, nil
+}
+
+// Close closes the file being read
+func (fr *FilesReader) Close() error {
+	fr.closeFile()
+	return nil
+}
@@ -0,0 +1,71 @@
+package inputreader
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilesReader(t *testing.T) {
+	dir := tailDir(t)
+	defer os.RemoveAll(dir)
+	past := time.Date(2019, time.December, 31, 12, 0, 0, 0, time.UTC)
+
+	write := func(name string, data string, mtime time.Time) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w io.WriteCloser = f
+		if filepath.Ext(name) == ".gz" {
+			w = gzip.NewWriter(f)
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		f.Close()
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().Truncate(time.Second)
+	write("auth.log", "four\n", now)
+	write("auth.log.1", "three\n", now.Add(-time.Hour))
+	write("auth.log.2.gz", "one\ntwo", past)
+	write(".hidden", "skipped\n", now)
+
+	fr, err := NewFilesReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+
+	// Oldest rotation first, lines dated by their file
+	var got []string
+	for {
+		l, err := fr.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(l.Data))
+		if l.Source == filepath.Join(dir, "auth.log.2.gz") && !l.Modified.Equal(past) {
+			t.Errorf("line %q modified %v, want %v", l.Data, l.Modified, past)
+		}
+	}
+	if want := []string{"one", "two", "three", "four"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+
+	if _, err := NewFilesReader(filepath.Join(dir, "*.none")); err == nil {
+		t.Error("NewFilesReader() of a pattern matching nothing should fail")
+	}
+}
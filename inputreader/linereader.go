@@ -0,0 +1,74 @@
+package inputreader
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+)
+
+type (
+	// Line is a logline along with where it comes from
+	Line struct {
+		// Logline, without line terminator
+		Data []byte
+		// UUID of the D4 sensor that sent the line, when known
+		Sensor string
+		// Queue, stream or file the line was read from
+		Source string
+		// Modification time of the file the line was read from, which
+		// dates timestamps without year, zero for other sources
+		Modified time.Time
+	}
+
+	// LineReader is implemented by readers that know where
+	// their lines come from. ReadLine returns io.EOF when no
+	// line is available for now
+	LineReader interface {
+		ReadLine() (*Line, error)
+	}
+
+	// Acknowledger is implemented by readers that need to know when
+	// the lines they returned have been processed, e.g. to checkpoint
+	// their progress. Ack acknowledges every line returned so far
+	Acknowledger interface {
+		Ack() error
+	}
+
+	// partialAcknowledger is implemented by acknowledgers able to
+	// acknowledge the first n lines returned since the last
+	// acknowledgement only, for FanInReader which reads ahead
+	partialAcknowledger interface {
+		ackFirst(n int) error
+	}
+
+	// Blocking is implemented by readers that may wait for new
+	// data themselves before returning io.EOF
+	Blocking interface {
+		Blocking() bool
+	}
+
+	// lineReader turns any io.Reader into a LineReader
+	lineReader struct {
+		r *bufio.Reader
+	}
+)
+
+// NewLineReader returns r if it is a LineReader, or reads
+// r line by line otherwise
+func NewLineReader(r io.Reader) LineReader {
+	if lr, ok := r.(LineReader); ok {
+		return lr
+	}
+	return &lineReader{r: bufio.NewReader(r)}
+}
+
+// ReadLine returns the next line, a last line without
+// terminator is returned when reaching EOF
+func (l *lineReader) ReadLine() (*Line, error) {
+	b, err := l.r.ReadBytes('\n')
+	if len(b) > 0 && (err == nil || err == io.EOF) {
+		return &Line{Data: bytes.TrimRight(b, "\r\n")}, nil
+	}
+	return nil, err
+}
@@ -2,13 +2,21 @@ package inputreader
 
 import (
 	"bytes"
-	"github.com/gomodule/redigo/redis"
 	"io"
 	"log"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
 )
 
 // RedisLPOPReader is a abstraction of LPOP list
-// and behaves like a reader
+// and behaves like a reader.
+//
+// Elements are read batch by batch with LRANGE and only removed from
+// the head of the queue once acknowledged, so that a crash does not
+// lose them: the queue must be appended to with RPUSH, and read by a
+// single analyzer. An empty queue is waited on for block before
+// returning io.EOF
 type RedisLPOPReader struct {
 	// D4 redis connection
 	r *redis.Conn
@@ -16,12 +24,30 @@ type RedisLPOPReader struct {
 	d int
 	// D4 Queue storing
 	q string
+	// Maximum number of elements read at once
+	batch int
+	// BRPOPLPUSH timeout, no wait when 0
+	block time.Duration
+	// Elements read and not yet returned
+	items [][]byte
+	// Elements read from the head of the queue and not yet removed
+	fetched int
+	// Elements returned and not yet acknowledged
+	unacked int
 	// Current buffer
 	buf []byte
+	// Counters since the last report
+	read    int
+	batches int
+	waits   int
+	since   time.Time
 }
 
+// Period between two reports of the counters
+const reportPeriod = time.Minute
+
 // NewLPOPReader creates a new RedisLPOPScanner
-func NewLPOPReader(rc *redis.Conn, db int, queue string) *RedisLPOPReader {
+func NewLPOPReader(rc *redis.Conn, db int, queue string, batch int, block time.Duration) *RedisLPOPReader {
 	rr := *rc
 
 	if _, err := rr.Do("SELECT", db); err != nil {
@@ -29,29 +55,140 @@ func NewLPOPReader(rc *redis.Conn, db int, queue string) *RedisLPOPReader {
 		log.Fatal(err)
 	}
 
+	if batch < 1 {
+		batch = 1
+	}
+	// BRPOPLPUSH timeouts are in seconds, 0 meaning forever
+	if block > 0 && block < time.Second {
+		block = time.Second
+	}
+
 	return &RedisLPOPReader{
-		r:           rc,
-		d:           db,
-		q:           queue,
+		r:     rc,
+		d:     db,
+		q:     queue,
+		batch: batch,
+		block: block,
+		since: time.Now(),
 	}
 }
 
-// Read LPOP the redis queue and use a bytes reader to copy
-// the resulting data in p
-func (rl *RedisLPOPReader) Read(p []byte) (n int, err error) {
+// ReadLine returns the next element of the queue,
+// io.EOF when the queue is empty
+func (rl *RedisLPOPReader) ReadLine() (*Line, error) {
+	for len(rl.items) == 0 {
+		if err := rl.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	item := rl.items[0]
+	rl.items = rl.items[1:]
+	rl.read++
+	rl.unacked++
+	return &Line{Data: bytes.TrimRight(item, "\r\n"), Source: rl.q}, nil
+}
+
+// fetch reads the next batch of elements, following those read
+// already. When there are none, it waits for one if the queue is
+// empty, and returns nil once there is
+func (rl *RedisLPOPReader) fetch() error {
 	rr := *rl.r
+	rl.report()
 
-	buf, err := redis.Bytes(rr.Do("LPOP", rl.q))
-	// If redis return empty: EOF (user should not stop)
+	items, err := redis.ByteSlices(rr.Do("LRANGE", rl.q, rl.fetched, rl.fetched+rl.batch-1))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if len(items) > 0 {
+		rl.items = items
+		rl.fetched += len(items)
+		rl.batches++
+		return nil
+	}
+
+	// If redis return empty: EOF (user should not stop), elements
+	// read are acknowledged first as waiting would reorder them
+	if rl.block == 0 || rl.fetched > 0 {
+		return io.EOF
+	}
+	rl.waits++
+	// Moving the tail of the queue to its head waits for an element
+	// without removing it, elements pushed at once may be reordered
+	_, err = redis.Bytes(rr.Do("BRPOPLPUSH", rl.q, rl.q, int(rl.block/time.Second)))
 	if err == redis.ErrNil {
-		return 0, io.EOF
+		return io.EOF
 	} else if err != nil {
 		log.Println(err)
-		return 0, err
+		return err
+	}
+	return nil
+}
+
+// Ack removes the elements returned from the queue
+func (rl *RedisLPOPReader) Ack() error {
+	return rl.ackFirst(rl.unacked)
+}
+
+// ackFirst removes the first n elements returned
+// since the last acknowledgement from the queue
+func (rl *RedisLPOPReader) ackFirst(n int) error {
+	if n > rl.unacked {
+		n = rl.unacked
+	}
+	if n <= 0 {
+		return nil
+	}
+	if _, err := (*rl.r).Do("LTRIM", rl.q, n, -1); err != nil {
+		return err
+	}
+	rl.fetched -= n
+	rl.unacked -= n
+	return nil
+}
+
+// report logs the throughput and the depth of the queue
+// once per reportPeriod, when there was something to read
+func (rl *RedisLPOPReader) report() {
+	elapsed := time.Since(rl.since)
+	if elapsed < reportPeriod {
+		return
+	}
+	depth, err := redis.Int((*rl.r).Do("LLEN", rl.q))
+	if err != nil {
+		log.Println(err)
+	}
+	if rl.read > 0 || depth > 0 {
+		log.Printf("Queue %v: %v lines read in %v batches (%.1f lines/s), %v waits, %v lines queued",
+			rl.q, rl.read, rl.batches, float64(rl.read)/elapsed.Seconds(), rl.waits, depth)
+	}
+	rl.read, rl.batches, rl.waits = 0, 0, 0
+	rl.since = time.Now()
+}
+
+// Blocking tells the reader waits for new elements itself
+func (rl *RedisLPOPReader) Blocking() bool {
+	return rl.block > 0
+}
+
+// Read LPOP the redis queue and copy the resulting data in p,
+// each element is terminated by a newline. What does not fit
+// in p is kept for the next call. Elements are acknowledged
+// once read
+func (rl *RedisLPOPReader) Read(p []byte) (n int, err error) {
+	if len(rl.buf) == 0 {
+		l, err := rl.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		if err := rl.Ack(); err != nil {
+			return 0, err
+		}
+		rl.buf = append(l.Data, '\n')
 	}
-	rreader := bytes.NewReader(buf)
-	n, err = rreader.Read(p)
-	return n, err
+	n = copy(p, rl.buf)
+	rl.buf = rl.buf[n:]
+	return n, nil
 }
 
 // Teardown is called on error to close the redis connection
@@ -0,0 +1,271 @@
+package inputreader
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// RedisStreamReader consumes a redis stream as a member of a consumer
+// group: entries are acknowledged once processed, so that a crash
+// does not lose them.
+//
+// On start, the entries delivered to the consumer but not acknowledged
+// are read first. When claimIdle is set, entries left pending by other
+// consumers for longer than claimIdle are claimed once the stream is
+// drained, so that several instances can share a stream.
+//
+// The logline is the "line" field of the entry, or its only field. The
+// "sensor" field, when present, is the sensor UUID.
+type RedisStreamReader struct {
+	// Input redis connection
+	r *redis.Conn
+	// Stream, group and consumer names
+	stream   string
+	group    string
+	consumer string
+	// Minimum idle time of entries claimed from other consumers
+	claimIdle time.Duration
+	// How long to wait for new entries, no wait when 0
+	block time.Duration
+	// ID to read from: "0" for our pending entries, ">" for new ones
+	from string
+	// Entries read and not yet returned
+	entries []streamEntry
+	// IDs of the entries returned and not yet acknowledged
+	unacked []string
+	// Current buffer, for Read
+	buf []byte
+}
+
+// streamEntry is an entry of a redis stream
+type streamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// Number of entries fetched per request
+const streamBatch = 100
+
+// NewRedisStreamReader joins group on stream in database db as consumer,
+// the group is created if needed, starting with the first entry
+func NewRedisStreamReader(rc *redis.Conn, db int, stream string, group string, consumer string, claimIdle time.Duration, block time.Duration) (*RedisStreamReader, error) {
+	rr := *rc
+
+	if _, err := rr.Do("SELECT", db); err != nil {
+		rr.Close()
+		return nil, err
+	}
+
+	_, err := rr.Do("XGROUP", "CREATE", stream, group, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		rr.Close()
+		return nil, err
+	}
+
+	return &RedisStreamReader{
+		r:         rc,
+		stream:    stream,
+		group:     group,
+		consumer:  consumer,
+		claimIdle: claimIdle,
+		block:     block,
+		from:      "0",
+	}, nil
+}
+
+// ReadLine returns the next entry of the stream,
+// io.EOF when there is none for now
+func (sr *RedisStreamReader) ReadLine() (*Line, error) {
+	for len(sr.entries) == 0 {
+		if err := sr.fetch(); err != nil {
+			return nil, err
+		}
+	}
+
+	e := sr.entries[0]
+	sr.entries = sr.entries[1:]
+	sr.unacked = append(sr.unacked, e.id)
+
+	l := &Line{Sensor: e.fields["sensor"], Source: sr.stream}
+	if v, ok := e.fields["line"]; ok {
+		l.Data = []byte(v)
+	} else if len(e.fields) == 1 {
+		for _, v := range e.fields {
+			l.Data = []byte(v)
+		}
+	}
+	return l, nil
+}
+
+// fetch reads the next batch of entries, pending ones first
+func (sr *RedisStreamReader) fetch() error {
+	rr := *sr.r
+
+	args := redis.Args{}.Add("GROUP", sr.group, sr.consumer, "COUNT", streamBatch)
+	// Only new entries are worth waiting for
+	if sr.from == ">" && sr.block > 0 {
+		args = args.Add("BLOCK", int64(sr.block/time.Millisecond))
+	}
+	reply, err := rr.Do("XREADGROUP", args.Add("STREAMS", sr.stream, sr.from)...)
+	if err != nil {
+		return err
+	}
+	entries, err := streamEntries(reply)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		sr.entries = entries
+		if sr.from != ">" {
+			sr.from = entries[len(entries)-1].id
+		}
+		return nil
+	}
+
+	// Our pending entries are processed, read new ones
+	if sr.from != ">" {
+		sr.from = ">"
+		return nil
+	}
+
+	if sr.claimIdle > 0 {
+		n, err := sr.claim()
+		if err != nil || n > 0 {
+			return err
+		}
+	}
+	return io.EOF
+}
+
+// claim takes over entries pending for longer than claimIdle, they
+// are read on the next fetch. It returns the number of entries claimed
+func (sr *RedisStreamReader) claim() (int, error) {
+	rr := *sr.r
+
+	pending, err := redis.Values(rr.Do("XPENDING", sr.stream, sr.group, "-", "+", streamBatch))
+	if err != nil {
+		return 0, err
+	}
+	idle := int64(sr.claimIdle / time.Millisecond)
+	args := redis.Args{}.Add(sr.stream, sr.group, sr.consumer, idle)
+	n := 0
+	for _, p := range pending {
+		// id, consumer, idle time, deliveries
+		pv, err := redis.Values(p, nil)
+		if err != nil || len(pv) < 3 {
+			return 0, fmt.Errorf("unexpected XPENDING reply: %v", p)
+		}
+		consumer, _ := redis.String(pv[1], nil)
+		ms, _ := redis.Int64(pv[2], nil)
+		if consumer != sr.consumer && ms >= idle {
+			id, _ := redis.String(pv[0], nil)
+			args = args.Add(id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if _, err := rr.Do("XCLAIM", append(args, "JUSTID")...); err != nil {
+		return 0, err
+	}
+	// Claimed entries are now our pending entries
+	sr.from = "0"
+	return n, nil
+}
+
+// streamEntries decodes a XREADGROUP reply on a single stream
+func streamEntries(reply interface{}) ([]streamEntry, error) {
+	if reply == nil {
+		return nil, nil
+	}
+	streams, err := redis.Values(reply, nil)
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil || len(stream) != 2 {
+		return nil, fmt.Errorf("unexpected XREADGROUP reply: %v", streams[0])
+	}
+	items, err := redis.Values(stream[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []streamEntry
+	for _, item := range items {
+		iv, err := redis.Values(item, nil)
+		if err != nil || len(iv) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry: %v", item)
+		}
+		id, err := redis.String(iv[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		e := streamEntry{id: id, fields: make(map[string]string)}
+		// Entries deleted while pending have no fields
+		if iv[1] != nil {
+			e.fields, err = redis.StringMap(iv[1], nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Ack acknowledges the entries returned
+func (sr *RedisStreamReader) Ack() error {
+	return sr.ackFirst(len(sr.unacked))
+}
+
+// ackFirst acknowledges the first n entries
+// returned since the last acknowledgement
+func (sr *RedisStreamReader) ackFirst(n int) error {
+	if n > len(sr.unacked) {
+		n = len(sr.unacked)
+	}
+	if n <= 0 {
+		return nil
+	}
+	rr := *sr.r
+	args := redis.Args{}.Add(sr.stream, sr.group).AddFlat(sr.unacked[:n])
+	if _, err := rr.Do("XACK", args...); err != nil {
+		return err
+	}
+	sr.unacked = sr.unacked[n:]
+	return nil
+}
+
+// Blocking tells the reader waits for new entries itself
+func (sr *RedisStreamReader) Blocking() bool {
+	return sr.block > 0
+}
+
+// Read copies the next logline in p, each line is terminated
+// by a newline. Entries are acknowledged once read
+func (sr *RedisStreamReader) Read(p []byte) (n int, err error) {
+	if len(sr.buf) == 0 {
+		l, err := sr.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		if err := sr.Ack(); err != nil {
+			return 0, err
+		}
+		sr.buf = append(l.Data, '\n')
+	}
+	n = copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// Teardown is called on error to close the redis connection
+func (sr *RedisStreamReader) Teardown() {
+	(*sr.r).Close()
+}
@@ -0,0 +1,221 @@
+package inputreader
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// SyslogServer receives syslog messages over UDP and TCP,
+	// every message is handed to each of its readers
+	SyslogServer struct {
+		mu      sync.Mutex
+		readers []*SyslogReader
+		udp     net.PacketConn
+		tcp     net.Listener
+	}
+
+	// SyslogReader gets the messages received by a SyslogServer,
+	// and behaves like a reader
+	SyslogReader struct {
+		c chan *Line
+		// Current buffer, for Read
+		buf []byte
+	}
+)
+
+const (
+	// Maximum size of a syslog message
+	maxSyslogMessage = 64 * 1024
+	// Time without message after which ReadLine returns io.EOF
+	syslogIdle = time.Second
+)
+
+// NewSyslogServer listens for syslog messages on udpAddr and tcpAddr,
+// either can be empty to disable it
+func NewSyslogServer(udpAddr string, tcpAddr string) (*SyslogServer, error) {
+	s := &SyslogServer{}
+	if udpAddr != "" {
+		c, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		s.udp = c
+		log.Printf("Listening for syslog on udp %v", c.LocalAddr())
+	}
+	if tcpAddr != "" {
+		l, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.tcp = l
+		log.Printf("Listening for syslog on tcp %v", l.Addr())
+	}
+	return s, nil
+}
+
+// NewReader returns a new reader of the server's messages,
+// readers should be created before calling Serve
+func (s *SyslogServer) NewReader() *SyslogReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &SyslogReader{c: make(chan *Line, 1024)}
+	s.readers = append(s.readers, r)
+	return r
+}
+
+// Serve starts receiving messages in the background
+func (s *SyslogServer) Serve() {
+	if s.udp != nil {
+		go s.serveUDP()
+	}
+	if s.tcp != nil {
+		go s.serveTCP()
+	}
+}
+
+// Close stops listening
+func (s *SyslogServer) Close() {
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+}
+
+// dispatch hands a message to every reader, slow
+// readers slow down the senders
+func (s *SyslogServer) dispatch(msg []byte) {
+	msg = bytes.TrimRight(msg, "\r\n\x00")
+	if len(msg) == 0 {
+		return
+	}
+	s.mu.Lock()
+	readers := s.readers
+	s.mu.Unlock()
+	for _, r := range readers {
+		r.c <- &Line{Data: append([]byte(nil), msg...), Source: "syslog"}
+	}
+}
+
+// serveUDP reads one message per datagram
+func (s *SyslogServer) serveUDP() {
+	buf := make([]byte, maxSyslogMessage)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Syslog udp listener stopped: %v", err)
+			return
+		}
+		s.dispatch(buf[:n])
+	}
+}
+
+func (s *SyslogServer) serveTCP() {
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			log.Printf("Syslog tcp listener stopped: %v", err)
+			return
+		}
+		go s.handleTCP(c)
+	}
+}
+
+// handleTCP reads messages framed following RFC 6587: octet counting
+// ("LEN SP MSG") when the frame starts with a number and a space,
+// newline terminated otherwise
+func (s *SyslogServer) handleTCP(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReaderSize(c, maxSyslogMessage)
+	for {
+		b, err := r.Peek(8)
+		if len(b) == 0 {
+			if err != io.EOF {
+				log.Printf("Syslog tcp connection from %v: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+
+		var msg []byte
+		if n := octetCount(b); n > 0 {
+			if n > maxSyslogMessage {
+				log.Printf("Syslog tcp connection from %v: frame too long (%v)", c.RemoteAddr(), n)
+				return
+			}
+			if _, err := r.ReadString(' '); err != nil {
+				return
+			}
+			msg = make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+		} else {
+			msg, err = r.ReadBytes('\n')
+			if err != nil && (err != io.EOF || len(msg) == 0) {
+				return
+			}
+		}
+		s.dispatch(msg)
+	}
+}
+
+// octetCount returns the length announced at the start
+// of an octet counted frame, 0 if b does not start one
+func octetCount(b []byte) int {
+	i := bytes.IndexByte(b, ' ')
+	if i <= 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(string(b[:i]))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// ReadLine waits for the next message, io.EOF is
+// returned once idle for syslogIdle
+func (sr *SyslogReader) ReadLine() (*Line, error) {
+	select {
+	case l := <-sr.c:
+		return l, nil
+	default:
+	}
+	t := time.NewTimer(syslogIdle)
+	defer t.Stop()
+	select {
+	case l := <-sr.c:
+		return l, nil
+	case <-t.C:
+		return nil, io.EOF
+	}
+}
+
+// Blocking tells ReadLine waits for messages itself
+func (sr *SyslogReader) Blocking() bool {
+	return true
+}
+
+// Read copies the next message in p, each message
+// is terminated by a newline
+func (sr *SyslogReader) Read(p []byte) (n int, err error) {
+	if len(sr.buf) == 0 {
+		l, err := sr.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		sr.buf = append(l.Data, '\n')
+	}
+	n = copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,143 @@
+package inputreader
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOctetCount(t *testing.T) {
+	tests := []struct {
+		frame string
+		want  int
+	}{
+		{"57 <34>1 2003-10-11T22:14:15.003Z", 57},
+		{"5 hello", 5},
+		{"<34>Oct 11 22:14:15 host su: message", 0},
+		{"Oct 11 22:14:15 host su: message", 0},
+		{"0 empty", 0},
+		{"-3 negative", 0},
+		{" 12 leading space", 0},
+		{"123", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := octetCount([]byte(tt.frame)); got != tt.want {
+			t.Errorf("octetCount(%q) = %v, want %v", tt.frame, got, tt.want)
+		}
+	}
+}
+
+func TestHandleTCPFraming(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{
+			name:   "newline terminated",
+			stream: "<34>Oct 11 22:14:15 host su: one\n<34>Oct 11 22:14:16 host su: two\r\n",
+			want:   []string{"<34>Oct 11 22:14:15 host su: one", "<34>Oct 11 22:14:16 host su: two"},
+		},
+		{
+			name:   "octet counted, with newlines inside",
+			stream: "5 hello10 multi\nline",
+			want:   []string{"hello", "multi\nline"},
+		},
+		{
+			name:   "mixed framing",
+			stream: "3 one<13>two\n5 three",
+			want:   []string{"one", "<13>two", "three"},
+		},
+		{
+			name:   "unterminated last line",
+			stream: "one\ntwo",
+			want:   []string{"one", "two"},
+		},
+		{
+			name:   "empty lines skipped",
+			stream: "one\n\n\ntwo\n",
+			want:   []string{"one", "two"},
+		},
+		{
+			name:   "truncated frame dropped",
+			stream: "5 hello20 short",
+			want:   []string{"hello"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SyslogServer{}
+			r := s.NewReader()
+			client, server := net.Pipe()
+			go func() {
+				io.WriteString(client, tt.stream)
+				client.Close()
+			}()
+			s.handleTCP(server)
+
+			// Every message is dispatched once the connection is closed
+			var got []string
+			for len(r.c) > 0 {
+				got = append(got, string((<-r.c).Data))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	s, err := NewSyslogServer("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r1, r2 := s.NewReader(), s.NewReader()
+	s.Serve()
+
+	c, err := net.Dial("udp", s.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("<34>Oct 11 22:14:15 host su: one\n\x00")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each reader gets every message, one per datagram
+	for _, r := range []*SyslogReader{r1, r2} {
+		l, err := r.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(l.Data) != "<34>Oct 11 22:14:15 host su: one" {
+			t.Errorf("ReadLine() = %q", l.Data)
+		}
+	}
+}
+
+func TestSyslogReaderRead(t *testing.T) {
+	s := &SyslogServer{}
+	r := s.NewReader()
+	s.dispatch([]byte(strings.Repeat("x", 10) + "\n"))
+
+	// Messages longer than p are kept for the next Read
+	p := make([]byte, 4)
+	var got []byte
+	for {
+		n, err := r.Read(p)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p[:n]...)
+	}
+	if want := strings.Repeat("x", 10) + "\n"; string(got) != want {
+		t.Errorf("Read() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,312 @@
+package inputreader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// TailReader follows a file like tail -F: it waits for new lines,
+	// follows rename and truncate rotations, and checkpoints its
+	// progress so that a restart resumes where it stopped
+	TailReader struct {
+		mu   sync.Mutex
+		path string
+		f    *os.File
+		fi   os.FileInfo
+		r    *bufio.Reader
+		// Offset of the next byte read from r
+		offset int64
+		// Incomplete last line
+		partial []byte
+		// Offset following the last line acknowledged
+		acked int64
+		// Offsets following the lines returned and not yet acknowledged
+		unacked []int64
+		// Checkpoint file, none when empty
+		checkpoint string
+		// Acks since the last saved checkpoint
+		unsaved int
+		// Time of the last saved checkpoint
+		saved time.Time
+		// Saves the acks left unsaved, when armed
+		timer *time.Timer
+		// Rotated file to drain before f
+		rotated *TailReader
+		// Rest of the line being copied, for Read
+		buf []byte
+	}
+
+	// tailCheckpoint is what is saved in the checkpoint file
+	tailCheckpoint struct {
+		Path   string `json:"path"`
+		Inode  uint64 `json:"inode"`
+		Offset int64  `json:"offset"`
+	}
+)
+
+// Longest time an acknowledged line stays out of the checkpoint
+const checkpointPeriod = time.Second
+
+// NewTailReader follows path, resuming from the checkpoint file when
+// it matches. When the checkpointed file has been rotated to path.1
+// while we were not running, it is finished first. Only path.1 is
+// looked for: a file rotated further, or compressed, is not found
+// and path is then read from its start
+func NewTailReader(path string, checkpoint string) (*TailReader, error) {
+	t := &TailReader{path: path, checkpoint: checkpoint}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+
+	if checkpoint == "" {
+		return t, nil
+	}
+	b, err := ioutil.ReadFile(checkpoint)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var c tailCheckpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+
+	if id, ok := fileID(t.fi); ok && id == c.Inode && c.Offset <= t.fi.Size() {
+		return t, t.seek(c.Offset)
+	}
+	// Rotated while we were not running
+	if fi, err := os.Stat(path + ".1"); err == nil {
+		if id, ok := fileID(fi); ok && id == c.Inode && c.Offset <= fi.Size() {
+			rotated := &TailReader{path: path + ".1"}
+			if err := rotated.open(); err != nil {
+				return nil, err
+			}
+			if err := rotated.seek(c.Offset); err != nil {
+				return nil, err
+			}
+			log.Printf("Finishing rotated file %v from offset %v", rotated.path, c.Offset)
+			t.rotated = rotated
+		}
+	}
+	return t, nil
+}
+
+func (t *TailReader) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f, t.fi = f, fi
+	t.r = bufio.NewReader(f)
+	t.offset, t.acked, t.unacked, t.partial = 0, 0, nil, nil
+	return nil
+}
+
+func (t *TailReader) seek(offset int64) error {
+	if _, err := t.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	t.r.Reset(t.f)
+	t.offset, t.acked, t.unacked, t.partial = offset, offset, nil, nil
+	return nil
+}
+
+// ReadLine returns the next complete line, io.EOF when
+// there is none for now. The lines of a file are acknowledged
+// before moving to the next one, so that the checkpoint only
+// ever refers to one file
+func (t *TailReader) ReadLine() (*Line, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rotated != nil {
+		l, err := t.rotated.readLine(true)
+		if err != io.EOF {
+			return l, err
+		}
+		if len(t.rotated.unacked) > 0 {
+			return nil, io.EOF
+		}
+		t.rotated.f.Close()
+		t.rotated = nil
+	}
+
+	l, err := t.readLine(false)
+	if err != io.EOF {
+		return l, err
+	}
+
+	// Check for rotation, once the lines read are acknowledged
+	if len(t.unacked) > 0 {
+		return nil, io.EOF
+	}
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		// Renamed, not yet recreated
+		return nil, io.EOF
+	}
+	if !os.SameFile(fi, t.fi) {
+		// Renamed and recreated: finish the old file, which
+		// was drained already but for an unterminated line
+		if len(t.partial) > 0 {
+			return t.readLine(true)
+		}
+		log.Printf("%v rotated, following the new file", t.path)
+		t.f.Close()
+		if err := t.open(); err != nil {
+			return nil, err
+		}
+		t.saveCheckpoint()
+		return t.readLine(false)
+	}
+	if fi.Size() < t.offset {
+		log.Printf("%v truncated, reading from the start", t.path)
+		if err := t.seek(0); err != nil {
+			return nil, err
+		}
+		t.fi = fi
+		t.saveCheckpoint()
+		return t.readLine(false)
+	}
+	// Caught up, later lines are dated from now on
+	t.fi = fi
+	return nil, io.EOF
+}
+
+// readLine returns the next complete line, or the unterminated
+// last one when final is set
+func (t *TailReader) readLine(final bool) (*Line, error) {
+	b, err := t.r.ReadBytes('\n')
+	t.offset += int64(len(b))
+	t.partial = append(t.partial, b...)
+	if err == io.EOF && final && len(t.partial) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &Line{Data: bytes.TrimRight(t.partial, "\r\n"), Source: t.path, Modified: t.fi.ModTime()}
+	t.partial = nil
+	t.unacked = append(t.unacked, t.offset)
+	return l, nil
+}
+
+// Ack tells the lines returned have been processed, the
+// checkpoint is saved at most checkpointPeriod afterwards
+func (t *TailReader) Ack() error {
+	return t.ackFirst(-1)
+}
+
+// ackFirst acknowledges the first n lines returned since
+// the last acknowledgement, all of them when n is negative
+func (t *TailReader) ackFirst(n int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cur := t
+	if t.rotated != nil {
+		cur = t.rotated
+	}
+	if n < 0 || n > len(cur.unacked) {
+		n = len(cur.unacked)
+	}
+	if n == 0 {
+		return nil
+	}
+	cur.acked = cur.unacked[n-1]
+	cur.unacked = cur.unacked[n:]
+	t.unsaved++
+	if time.Since(t.saved) >= checkpointPeriod {
+		return t.saveCheckpoint()
+	}
+	// Saved by the next acks, or once idle
+	if t.timer == nil {
+		t.timer = time.AfterFunc(checkpointPeriod, t.saveIdle)
+	}
+	return nil
+}
+
+// saveIdle saves the acks left unsaved
+func (t *TailReader) saveIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer = nil
+	if t.unsaved == 0 {
+		return
+	}
+	if err := t.saveCheckpoint(); err != nil {
+		log.Printf("Error saving the checkpoint of %v: %v", t.path, err)
+	}
+}
+
+// saveCheckpoint saves the position following the last
+// acknowledged line
+func (t *TailReader) saveCheckpoint() error {
+	if t.checkpoint == "" {
+		return nil
+	}
+	cur := t
+	if t.rotated != nil {
+		cur = t.rotated
+	}
+	c := tailCheckpoint{Path: cur.path, Offset: cur.acked}
+	c.Inode, _ = fileID(cur.fi)
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// Write and rename for the checkpoint to never be half written
+	tmp := t.checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	t.unsaved, t.saved = 0, time.Now()
+	return os.Rename(tmp, t.checkpoint)
+}
+
+// Read copies the next line in p, each line is terminated
+// by a newline. Lines are acknowledged once read
+func (t *TailReader) Read(p []byte) (n int, err error) {
+	if len(t.buf) == 0 {
+		l, err := t.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		if err := t.Ack(); err != nil {
+			return 0, err
+		}
+		t.buf = append(l.Data, '\n')
+	}
+	n = copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+// Close saves the checkpoint and closes the file
+func (t *TailReader) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	err := t.saveCheckpoint()
+	if t.rotated != nil {
+		t.rotated.f.Close()
+	}
+	t.f.Close()
+	return err
+}
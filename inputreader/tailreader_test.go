@@ -0,0 +1,281 @@
+package inputreader
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tailDir returns a scratch directory, to remove once done
+func tailDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tailreader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// rotate renames path to path.1, path.1 to path.2 and so on
+func rotate(t *testing.T, path string, n int) {
+	t.Helper()
+	for i := n; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%v.%v", path, i), fmt.Sprintf("%v.%v", path, i+1)); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendFile(t *testing.T, path string, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLines returns the lines available from tr, acknowledging
+// them at each io.EOF as pull does
+func readLines(t *testing.T, tr *TailReader) []string {
+	t.Helper()
+	var lines []string
+	unacked := 0
+	for {
+		l, err := tr.ReadLine()
+		if err == io.EOF {
+			if unacked == 0 {
+				return lines
+			}
+			if err := tr.Ack(); err != nil {
+				t.Fatal(err)
+			}
+			unacked = 0
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(l.Data))
+		unacked++
+	}
+}
+
+func expectLines(t *testing.T, tr *TailReader, want ...string) {
+	t.Helper()
+	if got := readLines(t, tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
+
+func TestTailReaderFollow(t *testing.T) {
+	dir := tailDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.log")
+	appendFile(t, path, "one\ntw")
+	tr, err := NewTailReader(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// Unterminated lines wait for their end
+	expectLines(t, tr, "one")
+	appendFile(t, path, "o\r\nthree\n")
+	expectLines(t, tr, "two", "three")
+	expectLines(t, tr)
+}
+
+func TestTailReaderRotation(t *testing.T) {
+	dir := tailDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.log")
+	appendFile(t, path, "one\n")
+	tr, err := NewTailReader(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	expectLines(t, tr, "one")
+
+	// Lines written before the rename are read from the old file,
+	// its unterminated last line included
+	appendFile(t, path, "two\nthr")
+	rotate(t, path, 0)
+	expectLines(t, tr, "two")
+	appendFile(t, path, "four\n")
+	expectLines(t, tr, "thr", "four")
+
+	// Truncated in place
+	appendFile(t, path, "five\n")
+	expectLines(t, tr, "five")
+	if err := ioutil.WriteFile(path, []byte("six\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, tr, "six")
+
+	// The new file is read once the lines of the old one are acknowledged
+	appendFile(t, path, "seven\n")
+	rotate(t, path, 1)
+	appendFile(t, path, "eight\n")
+	if l, err := tr.ReadLine(); err != nil || string(l.Data) != "seven" {
+		t.Fatalf("ReadLine = %v, %v, want seven", l, err)
+	}
+	if _, err := tr.ReadLine(); err != io.EOF {
+		t.Fatalf("ReadLine error = %v, want io.EOF", err)
+	}
+	if err := tr.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, tr, "eight")
+}
+
+func TestTailReaderCheckpoint(t *testing.T) {
+	dir := tailDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.log")
+	checkpoint := filepath.Join(dir, "checkpoint")
+	appendFile(t, path, "one\ntwo\n")
+
+	tr, err := NewTailReader(path, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, tr, "one", "two")
+	// Returned but not acknowledged, read again after a restart
+	appendFile(t, path, "three\n")
+	if _, err := tr.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err = NewTailReader(path, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, tr, "three")
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotated while stopped: the rest of path.1 comes first
+	appendFile(t, path, "four\n")
+	rotate(t, path, 1)
+	appendFile(t, path, "five\n")
+	tr, err = NewTailReader(path, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, tr, "four", "five")
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotated further, path is read from its start
+	rotate(t, path, 1)
+	appendFile(t, path, "six\n")
+	rotate(t, path, 2)
+	appendFile(t, path, "seven\n")
+	tr, err = NewTailReader(path, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	expectLines(t, tr, "seven")
+}
+
+func TestTailReaderModified(t *testing.T) {
+	dir := tailDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.log")
+	if err := ioutil.WriteFile(path, []byte("one\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Date(2019, time.December, 31, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := NewTailReader(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	l, err := tr.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Modified.Equal(past) {
+		t.Errorf("Modified = %v, want %v", l.Modified, past)
+	}
+}
+
+func TestTailReaderCheckpointIdle(t *testing.T) {
+	dir := tailDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.log")
+	checkpoint := filepath.Join(dir, "checkpoint")
+	appendFile(t, path, "one\n")
+
+	tr, err := NewTailReader(path, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	expectLines(t, tr, "one")
+	appendFile(t, path, "two\nthree\n")
+	expectLines(t, tr, "two", "three")
+
+	// Acks are saved once idle, without closing the reader
+	time.Sleep(checkpointPeriod + 200*time.Millisecond)
+	resumed, err := NewTailReader(path, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	appendFile(t, path, "four\n")
+	expectLines(t, resumed, "four")
+}
+
+func TestTailReaderRead(t *testing.T) {
+	dir := tailDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.log")
+	long := strings.Repeat("x", 100)
+	appendFile(t, path, long+"\nshort\n")
+
+	tr, err := NewTailReader(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// Lines longer than p are returned over several reads
+	var got []byte
+	p := make([]byte, 16)
+	for {
+		n, err := tr.Read(p)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p[:n]...)
+	}
+	if want := long + "\nshort\n"; string(got) != want {
+		t.Errorf("Read() = %q, want %q", got, want)
+	}
+}
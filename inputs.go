@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/D4-project/analyzer-d4-log/inputreader"
+	"github.com/D4-project/analyzer-d4-log/logcompiler"
+	config "github.com/D4-project/d4-golang-utils/config"
+	"github.com/D4-project/d4-golang-utils/crypto/hash"
+	"github.com/gomodule/redigo/redis"
+)
+
+// source is a redis input of a compiler, among others
+type source struct {
+	name string
+	ri   redisconfInput
+}
+
+// newInput returns the input of a compiler depending on the input flags,
+// by default each compiler consumes the redis queue, or stream, named after
+// it. Compilers with sources in inputs/<name> read them all concurrently
+func newInput(name string, ri redisconfInput) io.Reader {
+	switch {
+	case *syslog:
+		return syslogServer.NewReader()
+	case *d4:
+		rcon, err := redisInput.Dial()
+		if err != nil {
+			log.Fatal("Could not connect to output line on Input Redis")
+		}
+		uuid, err := analyzerUUID(*confdir, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r, err := inputreader.NewD4AnalyzerReader(&rcon, ri.redisDB, 3, uuid, "analyzer-d4-log "+name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return r
+	}
+
+	sources, err := readSources(*confdir, name)
+	if err != nil {
+		log.Fatalf("Inputs config error: %v", err)
+	}
+	if len(sources) == 0 {
+		return newRedisReader(name, ri, redisInput)
+	}
+	var names []string
+	var readers []inputreader.LineReader
+	for _, s := range sources {
+		names = append(names, s.name)
+		r := newRedisReader(name, s.ri, newPool(s.ri.redisHost+":"+s.ri.redisPort, 16))
+		readers = append(readers, inputreader.NewLineReader(r))
+	}
+	return inputreader.NewFanInReader(names, readers, *retry)
+}
+
+// newRedisReader returns a reader on the queue, or stream, of a compiler
+func newRedisReader(name string, ri redisconfInput, pool *redis.Pool) io.Reader {
+	rcon, err := pool.Dial()
+	if err != nil {
+		log.Fatal("Could not connect to output line on Input Redis")
+	}
+	if ri.queue != "" {
+		name = ri.queue
+	}
+	if ri.stream {
+		r, err := inputreader.NewRedisStreamReader(&rcon, ri.redisDB, name, ri.group, ri.consumer, ri.claimIdle, ri.block)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return r
+	}
+	return inputreader.NewLPOPReader(&rcon, ri.redisDB, name, ri.batch, ri.block)
+}
+
+// readSources reads the sources of a compiler from inputs/<name>,
+// one "name host:port/db[?options]" per line
+func readSources(confdir string, name string) ([]source, error) {
+	conf := readOptionalConfig(confdir, filepath.Join("inputs", name))
+	var sources []source
+	seen := make(map[string]bool)
+	for i, l := range strings.Split(conf, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		f := strings.Fields(l)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("inputs/%v:%v: should be name host:port/db[?options]", name, i+1)
+		}
+		if seen[f[0]] {
+			return nil, fmt.Errorf("inputs/%v:%v: duplicate source %v", name, i+1, f[0])
+		}
+		seen[f[0]] = true
+		ri, err := parseRedisInput(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("inputs/%v:%v: %v", name, i+1, err)
+		}
+		sources = append(sources, source{name: f[0], ri: ri})
+	}
+	return sources, nil
+}
+
+// parseRedisInput parses a redis input configuration,
+// host:port/db followed by options after a "?"
+func parseRedisInput(conf string) (redisconfInput, error) {
+	ri := redisconfInput{}
+	conf, opts := splitOptions(conf)
+	ss := strings.Split(conf, "/")
+	if len(ss) <= 1 {
+		return ri, fmt.Errorf("missing database: should be host:port/database_name")
+	}
+	ri.redisDB, _ = strconv.Atoi(ss[1])
+	if err := ri.parseOptions(opts); err != nil {
+		return ri, err
+	}
+	ok, addr := config.IsNet(ss[0])
+	if !ok {
+		return ri, fmt.Errorf("invalid redis address %v", ss[0])
+	}
+	i := strings.LastIndex(addr, ":")
+	ri.redisHost = addr[:i]
+	ri.redisPort = addr[i+1:]
+	return ri, nil
+}
+
+// newDeadLetters returns the dead letter store of a configuration line,
+// either "file:path" or "host:port/db/list"
+func newDeadLetters(conf string) (logcompiler.DeadLetters, error) {
+	if strings.HasPrefix(conf, "file:") {
+		return logcompiler.NewFileDeadLetters(strings.TrimPrefix(conf, "file:")), nil
+	}
+	ss := strings.Split(conf, "/")
+	if len(ss) != 3 {
+		return nil, fmt.Errorf("should be host:port/db/list or file:path")
+	}
+	ok, addr := config.IsNet(ss[0])
+	if !ok {
+		return nil, fmt.Errorf("invalid redis address %v", ss[0])
+	}
+	db, err := strconv.Atoi(ss[1])
+	if err != nil {
+		return nil, err
+	}
+	return logcompiler.NewRedisDeadLetters(newPool(addr, 16), db, ss[2]), nil
+}
+
+// printDeadLetters prints the dead letters of a compiler, one JSON per line
+func printDeadLetters(name string, dls logcompiler.DeadLetters) error {
+	l, err := dls.List(name)
+	if err != nil {
+		return err
+	}
+	for _, dl := range l {
+		b, err := json.Marshal(dl)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
+
+// reinjectDeadLetters pushes the dead letters of a compiler back to
+// the tail of the queue they were read from, depending on the input flags
+func reinjectDeadLetters(name string, ri redisconfInput, dls logcompiler.DeadLetters) error {
+	if *syslog || *fromfile != "" {
+		return fmt.Errorf("dead letters can only be re-injected into redis inputs")
+	}
+
+	// Dead letters of compilers with several sources
+	// go back to the source they were read from
+	sources, err := readSources(*confdir, name)
+	if err != nil {
+		return err
+	}
+	if *d4 || len(sources) == 0 {
+		sources = []source{{ri: ri}}
+	}
+	pushers := make(map[string]func(logcompiler.DeadLetter) error)
+	for _, s := range sources {
+		var pool *redis.Pool
+		if s.name == "" {
+			pool = redisInput
+		} else {
+			pool = newPool(s.ri.redisHost+":"+s.ri.redisPort, 16)
+		}
+		rcon, err := pool.Dial()
+		if err != nil {
+			return err
+		}
+		defer rcon.Close()
+		push, err := newPusher(rcon, name, s.ri)
+		if err != nil {
+			return err
+		}
+		pushers[s.name] = push
+	}
+
+	n := 0
+	err = dls.Drain(name, func(dl logcompiler.DeadLetter) error {
+		push, ok := pushers[""]
+		if !ok {
+			if push, ok = pushers[dl.Source]; !ok {
+				return fmt.Errorf("%v: unknown source %v", name, dl.Source)
+			}
+		}
+		if err := push(dl); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	fmt.Printf("%v: %v dead letters re-injected\n", name, n)
+	return err
+}
+
+// newPusher returns a function pushing dead letters
+// to the tail of the input queue of a compiler
+func newPusher(rcon redis.Conn, name string, ri redisconfInput) (func(logcompiler.DeadLetter) error, error) {
+	if _, err := rcon.Do("SELECT", ri.redisDB); err != nil {
+		return nil, err
+	}
+	queue := name
+	if ri.queue != "" {
+		queue = ri.queue
+	}
+
+	switch {
+	case *d4:
+		uuid, err := analyzerUUID(*confdir, name)
+		if err != nil {
+			return nil, err
+		}
+		q := fmt.Sprintf("analyzer:3:%v", uuid)
+		return func(dl logcompiler.DeadLetter) error {
+			line := dl.Line
+			if dl.Sensor != "" {
+				line = dl.Sensor + ":" + line
+			}
+			_, err := rcon.Do("RPUSH", q, line)
+			return err
+		}, nil
+	case ri.stream:
+		return func(dl logcompiler.DeadLetter) error {
+			args := redis.Args{}.Add(queue, "*", "line", dl.Line)
+			if dl.Sensor != "" {
+				args = args.Add("sensor", dl.Sensor)
+			}
+			_, err := rcon.Do("XADD", args...)
+			return err
+		}, nil
+	default:
+		return func(dl logcompiler.DeadLetter) error {
+			_, err := rcon.Do("RPUSH", queue, dl.Line)
+			return err
+		}, nil
+	}
+}
+
+// splitOptions splits a configuration line in its value
+// and the options following a "?"
+func splitOptions(s string) (string, string) {
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// parseOptions reads the redis input options. Lists are popped 500
+// elements at a time and reads wait 5s for new data by default. The
+// stream mode defaults to the "analyzer-d4-log" group and to the
+// hostname as consumer
+func (ri *redisconfInput) parseOptions(opts string) error {
+	v, err := url.ParseQuery(opts)
+	if err != nil {
+		return err
+	}
+
+	ri.batch = 500
+	if b := v.Get("batch"); b != "" {
+		if ri.batch, err = strconv.Atoi(b); err != nil {
+			return err
+		}
+	}
+	ri.block = 5 * time.Second
+	if b := v.Get("block"); b != "" {
+		if ri.block, err = time.ParseDuration(b); err != nil {
+			return err
+		}
+	}
+
+	ri.queue = v.Get("queue")
+
+	switch mode := v.Get("mode"); mode {
+	case "", "list":
+		return nil
+	case "stream":
+		ri.stream = true
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+
+	ri.group = v.Get("group")
+	if ri.group == "" {
+		ri.group = "analyzer-d4-log"
+	}
+	ri.consumer = v.Get("consumer")
+	if ri.consumer == "" {
+		if ri.consumer, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+	if c := v.Get("claim"); c != "" {
+		if ri.claimIdle, err = time.ParseDuration(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readOptionalConfig returns the trimmed content of an
+// optional configuration file, empty if it does not exist
+func readOptionalConfig(confdir string, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(confdir, name))
+	if os.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// analyzerUUID returns the d4 analyzer UUID of a compiler,
+// it is generated and saved in the configuration directory on first use
+func analyzerUUID(confdir string, name string) (string, error) {
+	path := filepath.Join(confdir, "d4", name)
+	if b, err := ioutil.ReadFile(path); err == nil {
+		return strings.TrimSpace(string(b)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	uuid, err := hash.NewV4()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(uuid.String()+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Printf("Registering %v as d4 analyzer %v", name, uuid)
+	return uuid.String(), nil
+}
@@ -0,0 +1,124 @@
+package logcompiler
+
+import (
+	"time"
+)
+
+// Batch gathers the updates of one or more events, so that a
+// Storage writes them at once: increments of a same member are
+// summed, distinct and index members and markers deduplicated,
+// oldest and newest reduced to the earliest and latest days.
+// A Batch is not safe for concurrent use
+type Batch struct {
+	// Increments by statistics key and member
+	incrs map[string]map[string]float64
+	// Expiry of statistics keys, when set
+	expires map[string]time.Time
+	// Members of distinct counts by key
+	distinct map[string]map[string]bool
+	// Members of indexes by key
+	index map[string]map[string]bool
+	// Markers by granularity
+	marks map[string]map[string]bool
+	// Raw events by day, in the order they were appended
+	events map[string][][]byte
+	// Values to set
+	values map[string]string
+	// Earliest and latest days counted, YYYYMMDD
+	oldest, newest string
+	// Number of events counted
+	n int
+}
+
+// NewBatch returns an empty Batch
+func NewBatch() *Batch {
+	b := &Batch{}
+	b.Reset()
+	return b
+}
+
+// Reset empties the batch, once committed
+func (b *Batch) Reset() {
+	b.incrs = make(map[string]map[string]float64)
+	b.expires = make(map[string]time.Time)
+	b.distinct = make(map[string]map[string]bool)
+	b.index = make(map[string]map[string]bool)
+	b.marks = make(map[string]map[string]bool)
+	b.events = make(map[string][][]byte)
+	b.values = make(map[string]string)
+	b.oldest, b.newest = "", ""
+	b.n = 0
+}
+
+// Len returns the number of events in the batch
+func (b *Batch) Len() int {
+	return b.n
+}
+
+// Incr adds one to member of the statistics key, which
+// expires at expire unless expire is zero
+func (b *Batch) Incr(key string, member string, expire time.Time) {
+	m, ok := b.incrs[key]
+	if !ok {
+		m = make(map[string]float64)
+		b.incrs[key] = m
+	}
+	m[member]++
+	if !expire.IsZero() && expire.After(b.expires[key]) {
+		b.expires[key] = expire
+	}
+}
+
+// Add adds member to the distinct count key
+func (b *Batch) Add(key string, member string) {
+	m, ok := b.distinct[key]
+	if !ok {
+		m = make(map[string]bool)
+		b.distinct[key] = m
+	}
+	m[member] = true
+}
+
+// Index adds member to the index key, a
+// sorted set whose members all score 0
+func (b *Batch) Index(key string, member string) {
+	m, ok := b.index[key]
+	if !ok {
+		m = make(map[string]bool)
+		b.index[key] = m
+	}
+	m[member] = true
+}
+
+// Mark records that the output member of granularity
+// needs to be regenerated
+func (b *Batch) Mark(granularity string, member string) {
+	m, ok := b.marks[granularity]
+	if !ok {
+		m = make(map[string]bool)
+		b.marks[granularity] = m
+	}
+	m[member] = true
+}
+
+// Append appends a raw event to the events of day
+func (b *Batch) Append(day string, event []byte) {
+	b.events[day] = append(b.events[day], event)
+}
+
+// Set sets the value key
+func (b *Batch) Set(key string, value string) {
+	b.values[key] = value
+}
+
+// Count records an event of day, YYYYMMDD, extending
+// the oldest and newest days seen
+func (b *Batch) Count(day string) {
+	b.n++
+	if b.oldest == "" || day < b.oldest {
+		b.oldest = day
+	}
+	if day > b.newest {
+		b.newest = day
+	}
+}
@@ -0,0 +1,76 @@
+package logcompiler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	b := NewBatch()
+	soon, later := time.Unix(1000, 0), time.Unix(2000, 0)
+	b.Incr("20200301:statssrc", "1.2.3.4", later)
+	b.Incr("20200301:statssrc", "1.2.3.4", soon)
+	b.Incr("20200301:statssrc", "5.6.7.8", time.Time{})
+	b.Mark("daily", "20200301")
+	b.Mark("daily", "20200301")
+	for _, d := range []string{"20200302", "20200228", "20200301"} {
+		b.Count(d)
+	}
+
+	// Increments are summed, markers deduplicated and the latest expiry kept
+	if want := map[string]float64{"1.2.3.4": 2, "5.6.7.8": 1}; !reflect.DeepEqual(b.incrs["20200301:statssrc"], want) {
+		t.Errorf("increments = %v, want %v", b.incrs["20200301:statssrc"], want)
+	}
+	if got := b.expires["20200301:statssrc"]; !got.Equal(later) {
+		t.Errorf("expire = %v, want %v", got, later)
+	}
+	if len(b.marks["daily"]) != 1 {
+		t.Errorf("markers = %v", b.marks)
+	}
+	if b.Len() != 3 || b.oldest != "20200228" || b.newest != "20200302" {
+		t.Errorf("Len() = %v, oldest %v, newest %v", b.Len(), b.oldest, b.newest)
+	}
+
+	b.Reset()
+	if b.Len() != 0 || len(b.incrs) != 0 || len(b.marks) != 0 || b.oldest != "" {
+		t.Errorf("batch not empty after Reset(): %+v", b)
+	}
+}
+
+func TestCommitOldestNewest(t *testing.T) {
+	bs, done := newTestBolt(t, "sshd")
+	defer done()
+
+	days := func() (string, string) {
+		t.Helper()
+		oldest, err := bs.Get("oldest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		newest, err := bs.Get("newest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return oldest, newest
+	}
+	commit(t, bs, func(b *Batch) {
+		b.Count("20200301")
+		b.Count("20200305")
+	})
+	if oldest, newest := days(); oldest != "20200301" || newest != "20200305" {
+		t.Errorf("days = %v, %v", oldest, newest)
+	}
+
+	// They only ever move outwards
+	commit(t, bs, func(b *Batch) { b.Count("20200303") })
+	commit(t, bs, func(b *Batch) { b.Count("20200310") })
+	if oldest, newest := days(); oldest != "20200301" || newest != "20200310" {
+		t.Errorf("days = %v, %v, want 20200301, 20200310", oldest, newest)
+	}
+	// An empty batch changes nothing
+	commit(t, bs, func(b *Batch) {})
+	if oldest, newest := days(); oldest != "20200301" || newest != "20200310" {
+		t.Errorf("days after an empty commit = %v, %v", oldest, newest)
+	}
+}
@@ -0,0 +1,62 @@
+package logcompiler
+
+import (
+	"fmt"
+	"time"
+)
+
+// Bench stores and counts n generated events, committed batch events at
+// a time as pull does, and returns the number of events per second. The
+// storage should be a scratch one: it is flushed and its raw events are
+// deleted afterwards
+func (s *CompilerStruct) Bench(n int, batch int) (float64, error) {
+	if n <= 0 || batch <= 0 {
+		return 0, fmt.Errorf("bench needs events and a batch size")
+	}
+	// A month of events, with repeated values as in real logs
+	now := time.Now()
+	events := make([]*event, n)
+	for i := range events {
+		e := &event{
+			time:   now.Add(-time.Duration(i%(30*24*60)) * time.Minute),
+			fields: make(map[string]string),
+		}
+		for j, d := range s.dimensions {
+			e.fields[d.Key] = fmt.Sprintf("%v%d", d.Key, (i*(j+1))%997)
+		}
+		events[i] = e
+	}
+
+	b := NewBatch()
+	start := time.Now()
+	for _, e := range events {
+		if err := s.storeEvent(b, e, []byte("bench")); err != nil {
+			return 0, err
+		}
+		s.compileStats(b, e.time, e.fields)
+		if b.Len() < batch {
+			continue
+		}
+		if err := s.commit(b); err != nil {
+			return 0, err
+		}
+	}
+	if err := s.commit(b); err != nil {
+		return 0, err
+	}
+	rate := float64(n) / time.Since(start).Seconds()
+
+	if err := s.store.Flush(); err != nil {
+		return rate, err
+	}
+	days, err := s.store.Days()
+	if err != nil {
+		return rate, err
+	}
+	for _, d := range days {
+		if _, err := s.store.DeleteDay(d); err != nil {
+			return rate, err
+		}
+	}
+	return rate, nil
+}
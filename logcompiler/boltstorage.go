@@ -0,0 +1,661 @@
+package logcompiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of a compiler in a bolt database
+var (
+	// Statistics, a sub-bucket of members and scores per key
+	statsBucket = []byte("stats")
+	// Values
+	valuesBucket = []byte("values")
+	// Expiration times of statistics, unix seconds
+	expireBucket = []byte("expire")
+	// Dirty markers, a sub-bucket per granularity
+	dirtyBucket = []byte("dirty")
+	// Raw events, a sub-bucket of sequence numbered events per day
+	rawBucket = []byte("raw")
+	// Export lists, a sub-bucket of sequence numbered values per list
+	listsBucket = []byte("lists")
+)
+
+// BoltStorage implements Storage in a bolt database file, for
+// deployments without redis. Each compiler has its own bucket
+type BoltStorage struct {
+	db   *bolt.DB
+	name []byte
+}
+
+// OpenBolt opens the bolt database file path, creating it if needed.
+// A database file is used by a single process at a time
+func OpenBolt(path string) (*bolt.DB, error) {
+	return bolt.Open(filepath.Clean(path), 0600, &bolt.Options{Timeout: time.Second})
+}
+
+// NewBoltStorage returns the storage of the compiler name in db
+func NewBoltStorage(db *bolt.DB, name string) (*BoltStorage, error) {
+	bs := &BoltStorage{db: db, name: []byte(name)}
+	err := db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(bs.name)
+		if err != nil {
+			return err
+		}
+		for _, b := range [][]byte{statsBucket, valuesBucket, expireBucket, dirtyBucket, rawBucket, listsBucket} {
+			if _, err := root.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// bucket returns the bucket b of the compiler
+func (bs *BoltStorage) bucket(tx *bolt.Tx, b []byte) *bolt.Bucket {
+	return tx.Bucket(bs.name).Bucket(b)
+}
+
+// expired tells whether the statistics key has expired
+func (bs *BoltStorage) expired(tx *bolt.Tx, key string) bool {
+	v := bs.bucket(tx, expireBucket).Get([]byte(key))
+	return v != nil && int64(binary.BigEndian.Uint64(v)) <= time.Now().Unix()
+}
+
+// deleteStats deletes the statistics key and its expiration time
+func (bs *BoltStorage) deleteStats(tx *bolt.Tx, key string) error {
+	if err := bs.bucket(tx, statsBucket).DeleteBucket([]byte(key)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return bs.bucket(tx, expireBucket).Delete([]byte(key))
+}
+
+// setExpire sets the time the statistics key expires at
+func (bs *BoltStorage) setExpire(tx *bolt.Tx, key string, expire time.Time) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(expire.Unix()))
+	return bs.bucket(tx, expireBucket).Put([]byte(key), v)
+}
+
+func encodeScore(f float64) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, math.Float64bits(f))
+	return v
+}
+
+func decodeScore(v []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(v))
+}
+
+// Commit writes b in a single transaction
+func (bs *BoltStorage) Commit(b *Batch) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for day, events := range b.events {
+			for _, e := range events {
+				if err := appendSequence(bs.bucket(tx, rawBucket), day, e); err != nil {
+					return err
+				}
+			}
+		}
+
+		for key, members := range b.incrs {
+			if err := bs.incr(tx, key, members, b.expires[key]); err != nil {
+				return err
+			}
+		}
+
+		for key, members := range b.distinct {
+			d, err := bs.bucket(tx, statsBucket).CreateBucketIfNotExists([]byte(key))
+			if err != nil {
+				return err
+			}
+			for member := range members {
+				if err := d.Put([]byte(member), encodeScore(1)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for key, members := range b.index {
+			x, err := bs.bucket(tx, statsBucket).CreateBucketIfNotExists([]byte(key))
+			if err != nil {
+				return err
+			}
+			for member := range members {
+				if err := x.Put([]byte(member), encodeScore(0)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for granularity, members := range b.marks {
+			d, err := bs.bucket(tx, dirtyBucket).CreateBucketIfNotExists([]byte(granularity))
+			if err != nil {
+				return err
+			}
+			for member := range members {
+				if err := d.Put([]byte(member), nil); err != nil {
+					return err
+				}
+			}
+		}
+
+		values := bs.bucket(tx, valuesBucket)
+		for key, value := range b.values {
+			if err := values.Put([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+		}
+
+		if b.oldest == "" {
+			return nil
+		}
+		if oldest := values.Get([]byte("oldest")); oldest == nil || b.oldest < string(oldest) {
+			if err := values.Put([]byte("oldest"), []byte(b.oldest)); err != nil {
+				return err
+			}
+		}
+		if newest := values.Get([]byte("newest")); newest == nil || b.newest > string(newest) {
+			return values.Put([]byte("newest"), []byte(b.newest))
+		}
+		return nil
+	})
+}
+
+// incr adds to the members of the statistics key
+func (bs *BoltStorage) incr(tx *bolt.Tx, key string, members map[string]float64, expire time.Time) error {
+	if bs.expired(tx, key) {
+		if err := bs.deleteStats(tx, key); err != nil {
+			return err
+		}
+	}
+	b, err := bs.bucket(tx, statsBucket).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+	for member, n := range members {
+		score := n
+		if v := b.Get([]byte(member)); v != nil {
+			score += decodeScore(v)
+		}
+		if err := b.Put([]byte(member), encodeScore(score)); err != nil {
+			return err
+		}
+	}
+	if !expire.IsZero() {
+		return bs.setExpire(tx, key, expire)
+	}
+	return nil
+}
+
+// members returns the members of the statistics key, unsorted
+func (bs *BoltStorage) members(tx *bolt.Tx, key string) []Member {
+	if bs.expired(tx, key) {
+		return nil
+	}
+	b := bs.bucket(tx, statsBucket).Bucket([]byte(key))
+	if b == nil {
+		return nil
+	}
+	var members []Member
+	b.ForEach(func(k, v []byte) error {
+		members = append(members, Member{Name: string(k), Score: decodeScore(v)})
+		return nil
+	})
+	return members
+}
+
+// Members returns the members of the statistics key, by ascending
+// score, then ascending name as redis does
+func (bs *BoltStorage) Members(key string) ([]Member, error) {
+	var members []Member
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		members = bs.members(tx, key)
+		return nil
+	})
+	sort.SliceStable(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score < members[j].Score
+		}
+		return members[i].Name < members[j].Name
+	})
+	return members, err
+}
+
+// Top returns the n members of the statistics key with the highest scores
+func (bs *BoltStorage) Top(key string, n int) ([]Member, error) {
+	members, err := bs.Members(key)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+		members[i], members[j] = members[j], members[i]
+	}
+	if len(members) > n {
+		members = members[:n]
+	}
+	return members, nil
+}
+
+// Union sums the statistics keys into dest, which expires after ttl
+func (bs *BoltStorage) Union(dest string, keys []string, ttl time.Duration) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		sums := make(map[string]float64)
+		for _, k := range keys {
+			for _, m := range bs.members(tx, k) {
+				sums[m.Name] += m.Score
+			}
+		}
+		if err := bs.store(tx, dest, sums); err != nil {
+			return err
+		}
+		if ttl == 0 {
+			return nil
+		}
+		return bs.setExpire(tx, dest, time.Now().Add(ttl))
+	})
+}
+
+// Merge sets the distinct count dest to the union of the distinct counts keys
+func (bs *BoltStorage) Merge(dest string, keys []string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		members := make(map[string]float64)
+		for _, k := range keys {
+			for _, m := range bs.members(tx, k) {
+				members[m.Name] = 1
+			}
+		}
+		return bs.store(tx, dest, members)
+	})
+}
+
+// store replaces the statistics key with members
+func (bs *BoltStorage) store(tx *bolt.Tx, key string, members map[string]float64) error {
+	if err := bs.deleteStats(tx, key); err != nil {
+		return err
+	}
+	b, err := bs.bucket(tx, statsBucket).CreateBucket([]byte(key))
+	if err != nil {
+		return err
+	}
+	for m, score := range members {
+		if err := b.Put([]byte(m), encodeScore(score)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Distinct returns the exact distinct count of the keys, whose
+// members are kept as statistics
+func (bs *BoltStorage) Distinct(keys ...string) (int64, error) {
+	seen := make(map[string]bool)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		for _, k := range keys {
+			for _, m := range bs.members(tx, k) {
+				seen[m.Name] = true
+			}
+		}
+		return nil
+	})
+	return int64(len(seen)), err
+}
+
+// Exists tells whether the statistics key exists
+func (bs *BoltStorage) Exists(key string) (bool, error) {
+	exists := false
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		exists = !bs.expired(tx, key) && bs.bucket(tx, statsBucket).Bucket([]byte(key)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// Get returns the value key, or "" if it does not exist
+func (bs *BoltStorage) Get(key string) (string, error) {
+	var v string
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v = string(bs.bucket(tx, valuesBucket).Get([]byte(key)))
+		return nil
+	})
+	return v, err
+}
+
+// Set sets the value key
+func (bs *BoltStorage) Set(key string, value string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return bs.bucket(tx, valuesBucket).Put([]byte(key), []byte(value))
+	})
+}
+
+// Keys returns the statistics and values matching the glob pattern,
+// expired statistics met on the way are deleted
+func (bs *BoltStorage) Keys(pattern string) ([]string, error) {
+	var keys []string
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		keys = nil
+		var expired []string
+		err := bs.bucket(tx, statsBucket).ForEach(func(k, _ []byte) error {
+			if ok, _ := filepath.Match(pattern, string(k)); !ok {
+				return nil
+			}
+			if bs.expired(tx, string(k)) {
+				expired = append(expired, string(k))
+			} else {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bs.deleteStats(tx, k); err != nil {
+				return err
+			}
+		}
+		return bs.bucket(tx, valuesBucket).ForEach(func(k, _ []byte) error {
+			if ok, _ := filepath.Match(pattern, string(k)); ok {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// Remove removes members from the statistics key
+func (bs *BoltStorage) Remove(key string, members ...string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := bs.bucket(tx, statsBucket).Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		for _, m := range members {
+			if err := b.Delete([]byte(m)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete deletes statistics and values
+func (bs *BoltStorage) Delete(keys ...string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, k := range keys {
+			if err := bs.deleteStats(tx, k); err != nil {
+				return err
+			}
+			if err := bs.bucket(tx, valuesBucket).Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Take moves the markers of granularity aside and returns them
+func (bs *BoltStorage) Take(granularity string) ([]string, error) {
+	var taken []string
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		dirty := bs.bucket(tx, dirtyBucket)
+		t, err := dirty.CreateBucketIfNotExists([]byte(granularity + ":compiling"))
+		if err != nil {
+			return err
+		}
+		if b := dirty.Bucket([]byte(granularity)); b != nil {
+			err := b.ForEach(func(k, _ []byte) error {
+				return t.Put(k, nil)
+			})
+			if err != nil {
+				return err
+			}
+			if err := dirty.DeleteBucket([]byte(granularity)); err != nil {
+				return err
+			}
+		}
+		taken = nil
+		return t.ForEach(func(k, _ []byte) error {
+			taken = append(taken, string(k))
+			return nil
+		})
+	})
+	return taken, err
+}
+
+// Clear drops the markers taken
+func (bs *BoltStorage) Clear(granularity string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		err := bs.bucket(tx, dirtyBucket).DeleteBucket([]byte(granularity + ":compiling"))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// Marked returns the markers of granularity, taken or not
+func (bs *BoltStorage) Marked(granularity string) ([]string, error) {
+	marked := make(map[string]bool)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		for _, g := range []string{granularity, granularity + ":compiling"} {
+			if b := bs.bucket(tx, dirtyBucket).Bucket([]byte(g)); b != nil {
+				b.ForEach(func(k, _ []byte) error {
+					marked[string(k)] = true
+					return nil
+				})
+			}
+		}
+		return nil
+	})
+	members := make([]string, 0, len(marked))
+	for m := range marked {
+		members = append(members, m)
+	}
+	return members, err
+}
+
+// appendSequence appends value to the sub-bucket name of b
+func appendSequence(b *bolt.Bucket, name string, value []byte) error {
+	l, err := b.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return err
+	}
+	seq, err := l.NextSequence()
+	if err != nil {
+		return err
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return l.Put(k, value)
+}
+
+// Replay feeds the raw events of day to f. Events are read a batch at a
+// time, f is called out of any transaction so that it can write
+func (bs *BoltStorage) Replay(day string, f func([]byte) error) error {
+	var from []byte
+	for {
+		var batch [][]byte
+		err := bs.db.View(func(tx *bolt.Tx) error {
+			b := bs.bucket(tx, rawBucket).Bucket([]byte(day))
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
+			k, v := c.First()
+			if from != nil {
+				k, v = c.Seek(from)
+			}
+			for ; k != nil && len(batch) < replayBatch; k, v = c.Next() {
+				// v is only valid during the transaction
+				batch = append(batch, append([]byte(nil), v...))
+				from = append(append([]byte(nil), k...), 0)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, v := range batch {
+			if err := f(v); err != nil {
+				return err
+			}
+		}
+		if len(batch) < replayBatch {
+			return nil
+		}
+	}
+}
+
+// Days returns the days holding raw events
+func (bs *BoltStorage) Days() ([]string, error) {
+	var days []string
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return bs.bucket(tx, rawBucket).ForEach(func(k, _ []byte) error {
+			days = append(days, string(k))
+			return nil
+		})
+	})
+	return days, err
+}
+
+// DeleteDay deletes the raw events of day
+func (bs *BoltStorage) DeleteDay(day string) (int, error) {
+	n := 0
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		raw := bs.bucket(tx, rawBucket)
+		b := raw.Bucket([]byte(day))
+		if b == nil {
+			return nil
+		}
+		n = b.Stats().KeyN
+		return raw.DeleteBucket([]byte(day))
+	})
+	return n, err
+}
+
+// Push appends value to the export list
+func (bs *BoltStorage) Push(list string, value []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return appendSequence(bs.bucket(tx, listsBucket), list, value)
+	})
+}
+
+// Staging returns the storage of the <name>:staging bucket
+func (bs *BoltStorage) Staging() (Storage, error) {
+	return NewBoltStorage(bs.db, string(bs.name)+":staging")
+}
+
+// Swap copies the statistics and values of staging matching filter
+// over the ones of the storage matching filter, and deletes staging,
+// in a single transaction
+func (bs *BoltStorage) Swap(staging Storage, filter func(string) bool) ([]string, error) {
+	st, ok := staging.(*BoltStorage)
+	if !ok || st.db != bs.db {
+		return nil, fmt.Errorf("staging is not in the database")
+	}
+	var swapped []string
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		swapped = nil
+		// Current statistics and values
+		var current [][]byte
+		bs.bucket(tx, statsBucket).ForEach(func(k, _ []byte) error {
+			if filter(string(k)) {
+				current = append(current, k)
+			}
+			return nil
+		})
+		for _, k := range current {
+			if err := bs.deleteStats(tx, string(k)); err != nil {
+				return err
+			}
+		}
+		current = nil
+		values := bs.bucket(tx, valuesBucket)
+		values.ForEach(func(k, _ []byte) error {
+			if filter(string(k)) {
+				current = append(current, k)
+			}
+			return nil
+		})
+		for _, k := range current {
+			if err := values.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		// Staged ones
+		if tx.Bucket(st.name) == nil {
+			return nil
+		}
+		err := st.bucket(tx, statsBucket).ForEach(func(k, _ []byte) error {
+			if !filter(string(k)) {
+				return nil
+			}
+			b, err := bs.bucket(tx, statsBucket).CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			err = st.bucket(tx, statsBucket).Bucket(k).ForEach(func(m, score []byte) error {
+				return b.Put(m, score)
+			})
+			if err != nil {
+				return err
+			}
+			if v := st.bucket(tx, expireBucket).Get(k); v != nil {
+				if err := bs.bucket(tx, expireBucket).Put(k, v); err != nil {
+					return err
+				}
+			}
+			swapped = append(swapped, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = st.bucket(tx, valuesBucket).ForEach(func(k, v []byte) error {
+			if !filter(string(k)) {
+				return nil
+			}
+			swapped = append(swapped, string(k))
+			return values.Put(k, v)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket(st.name)
+	})
+	return swapped, err
+}
+
+// Flush deletes the statistics, values and markers
+func (bs *BoltStorage) Flush() error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(bs.name)
+		for _, b := range [][]byte{statsBucket, valuesBucket, expireBucket, dirtyBucket} {
+			if err := root.DeleteBucket(b); err != nil {
+				return err
+			}
+			if _, err := root.CreateBucket(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close does nothing, the database is closed by whoever opened it
+func (bs *BoltStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,292 @@
+package logcompiler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestBolt returns the storage of compiler name in a scratch
+// database, and a function removing it
+func newTestBolt(t *testing.T, name string) (*BoltStorage, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "boltstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenBolt(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	db.NoSync = true
+	bs, err := NewBoltStorage(db, name)
+	if err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return bs, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// commit commits the batch filled by f to s
+func commit(t *testing.T, s Storage, f func(b *Batch)) {
+	t.Helper()
+	b := NewBatch()
+	f(b)
+	if err := s.Commit(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStorageStats(t *testing.T) {
+	bs, done := newTestBolt(t, "sshd")
+	defer done()
+
+	commit(t, bs, func(b *Batch) {
+		for _, m := range []string{"root", "admin", "root", "test"} {
+			b.Incr("20200301:statsusername", m, time.Time{})
+		}
+		b.Incr("20200302:statsusername", "admin", time.Time{})
+	})
+	// Increments add up across commits
+	commit(t, bs, func(b *Batch) {
+		b.Incr("20200301:statsusername", "root", time.Time{})
+		b.Incr("20200301:statsusername", "admin", time.Time{})
+		b.Incr("20200302:statsusername", "admin", time.Time{})
+	})
+
+	members, err := bs.Members("20200301:statsusername")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Member{{"test", 1}, {"admin", 2}, {"root", 3}}; !reflect.DeepEqual(members, want) {
+		t.Errorf("Members() = %v, want %v", members, want)
+	}
+	top, err := bs.Top("20200301:statsusername", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Member{{"root", 3}, {"admin", 2}}; !reflect.DeepEqual(top, want) {
+		t.Errorf("Top() = %v, want %v", top, want)
+	}
+
+	if err := bs.Union("202003:statsusername", []string{"20200301:statsusername", "20200302:statsusername"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	top, err = bs.Top("202003:statsusername", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Member{{"admin", 4}}; !reflect.DeepEqual(top, want) {
+		t.Errorf("Top() of the union = %v, want %v", top, want)
+	}
+
+	if err := bs.Set("oldest", "20200301"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := bs.Get("oldest"); err != nil || v != "20200301" {
+		t.Errorf("Get() = %q, %v", v, err)
+	}
+	if v, err := bs.Get("missing"); err != nil || v != "" {
+		t.Errorf("Get() of a missing value = %q, %v", v, err)
+	}
+
+	// Expired statistics are not listed, and are deleted on the way
+	commit(t, bs, func(b *Batch) {
+		b.Incr("2020030110:statsusername", "root", time.Now().Add(-time.Second))
+	})
+	if ok, err := bs.Exists("2020030110:statsusername"); err != nil || ok {
+		t.Errorf("Exists() of an expired key = %v, %v", ok, err)
+	}
+	keys, err := bs.Keys("2020*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if want := []string{"20200301:statsusername", "20200302:statsusername", "202003:statsusername"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys() = %v, want %v", keys, want)
+	}
+	if n := bucketLen(t, bs, expireBucket); n != 1 {
+		t.Errorf("%v expiration times left, want the one of the union", n)
+	}
+
+	if err := bs.Delete("20200302:statsusername", "oldest"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := bs.Keys("*"); len(keys) != 2 {
+		t.Errorf("Keys() after Delete() = %v", keys)
+	}
+}
+
+// bucketLen returns the number of keys in the bucket b of bs
+func bucketLen(t *testing.T, bs *BoltStorage, b []byte) int {
+	t.Helper()
+	n := 0
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		n = bs.bucket(tx, b).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestBoltStorageMarkers(t *testing.T) {
+	bs, done := newTestBolt(t, "sshd")
+	defer done()
+
+	marked := func(taken []string, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(taken)
+		return taken
+	}
+	commit(t, bs, func(b *Batch) {
+		b.Mark("daily", "20200301")
+		b.Mark("daily", "20200302")
+		b.Mark("daily", "20200301")
+		b.Mark("monthly", "202003")
+	})
+	if got := marked(bs.Take("daily")); !reflect.DeepEqual(got, []string{"20200301", "20200302"}) {
+		t.Errorf("Take() = %v", got)
+	}
+
+	// Markers taken but not cleared come back with the new ones
+	commit(t, bs, func(b *Batch) { b.Mark("daily", "20200303") })
+	if got := marked(bs.Marked("daily")); !reflect.DeepEqual(got, []string{"20200301", "20200302", "20200303"}) {
+		t.Errorf("Marked() = %v", got)
+	}
+	if got := marked(bs.Take("daily")); !reflect.DeepEqual(got, []string{"20200301", "20200302", "20200303"}) {
+		t.Errorf("Take() after a failure = %v", got)
+	}
+	if err := bs.Clear("daily"); err != nil {
+		t.Fatal(err)
+	}
+	if got := marked(bs.Marked("daily")); len(got) != 0 {
+		t.Errorf("Marked() after Clear() = %v", got)
+	}
+	if got := marked(bs.Marked("monthly")); !reflect.DeepEqual(got, []string{"202003"}) {
+		t.Errorf("Marked() of another granularity = %v", got)
+	}
+}
+
+func TestBoltStorageRaw(t *testing.T) {
+	bs, done := newTestBolt(t, "sshd")
+	defer done()
+
+	// More than a batch of replay
+	n := replayBatch + 10
+	commit(t, bs, func(b *Batch) {
+		for i := 0; i < n; i++ {
+			b.Append("20200301", []byte(fmt.Sprint(i)))
+		}
+		b.Append("20200302", []byte("x"))
+		b.Incr("20200301:statssrc", "1.2.3.4", time.Time{})
+		b.Mark("daily", "20200301")
+	})
+
+	i := 0
+	err := bs.Replay("20200301", func(event []byte) error {
+		if string(event) != fmt.Sprint(i) {
+			t.Fatalf("event %v = %s", i, event)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != n {
+		t.Errorf("%v events replayed, want %v", i, n)
+	}
+
+	// Flush keeps the raw events only
+	if err := bs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := bs.Keys("*"); len(keys) != 0 {
+		t.Errorf("Keys() after Flush() = %v", keys)
+	}
+	if marked, _ := bs.Marked("daily"); len(marked) != 0 {
+		t.Errorf("Marked() after Flush() = %v", marked)
+	}
+	days, err := bs.Days()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"20200301", "20200302"}; !reflect.DeepEqual(days, want) {
+		t.Errorf("Days() = %v, want %v", days, want)
+	}
+
+	if deleted, err := bs.DeleteDay("20200301"); err != nil || deleted != n {
+		t.Errorf("DeleteDay() = %v, %v, want %v", deleted, err, n)
+	}
+	if deleted, err := bs.DeleteDay("20200301"); err != nil || deleted != 0 {
+		t.Errorf("DeleteDay() of a deleted day = %v, %v", deleted, err)
+	}
+	if days, _ := bs.Days(); !reflect.DeepEqual(days, []string{"20200302"}) {
+		t.Errorf("Days() after DeleteDay() = %v", days)
+	}
+}
+
+func TestBoltStorageCompilers(t *testing.T) {
+	bs, done := newTestBolt(t, "sshd")
+	defer done()
+	other, err := NewBoltStorage(bs.db, "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compilers sharing a database do not see each other's data
+	commit(t, bs, func(b *Batch) { b.Incr("20200301:statssrc", "1.2.3.4", time.Time{}) })
+	commit(t, other, func(b *Batch) { b.Append("20200301", []byte("x")) })
+	if keys, _ := other.Keys("*"); len(keys) != 0 {
+		t.Errorf("Keys() of another compiler = %v", keys)
+	}
+	if days, _ := bs.Days(); len(days) != 0 {
+		t.Errorf("Days() of another compiler = %v", days)
+	}
+}
+
+func TestBoltStorageDistinct(t *testing.T) {
+	bs, done := newTestBolt(t, "sshd")
+	defer done()
+
+	commit(t, bs, func(b *Batch) {
+		for _, src := range []string{"1.2.3.4", "5.6.7.8", "1.2.3.4"} {
+			b.Add("20200301:distinctsrc", src)
+		}
+		b.Add("20200302:distinctsrc", "1.2.3.4")
+	})
+	commit(t, bs, func(b *Batch) { b.Add("20200302:distinctsrc", "9.9.9.9") })
+
+	tests := []struct {
+		keys []string
+		want int64
+	}{
+		{[]string{"20200301:distinctsrc"}, 2},
+		{[]string{"20200302:distinctsrc"}, 2},
+		// Members of several keys are counted once
+		{[]string{"20200301:distinctsrc", "20200302:distinctsrc"}, 3},
+		{[]string{"20200303:distinctsrc"}, 0},
+	}
+	for _, tt := range tests {
+		if got, err := bs.Distinct(tt.keys...); err != nil || got != tt.want {
+			t.Errorf("Distinct(%v) = %v, %v, want %v", tt.keys, got, err, tt.want)
+		}
+	}
+}
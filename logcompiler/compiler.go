@@ -5,31 +5,52 @@ import (
 	"sync"
 	"time"
 
-	"github.com/D4-project/analyzer-d4-log/inputreader"
-	"github.com/gomodule/redigo/redis"
+	"github.com/D4-project/analyzer-d4-log/grok"
 )
 
 type (
 	// Compiler provides the interface for a Compiler
 	// It should provide:
-	//  Set to assign a redis connection to it
+	//  Set to assign a storage to it
 	//  Parse to parse a line of log
 	//  Flush recomputes statistics and recompile output
+	//  Pending lists the outputs waiting to be regenerated
+	//  Janitor deletes the data that left its retention window
+	//  Bench measures how fast events are stored and counted
+	//  Pairs returns the values seen with a value on a day
 	Compiler interface {
-		Set(*sync.WaitGroup, *redis.Conn, *redis.Conn, io.Reader, int, *sync.WaitGroup, *chan error, time.Duration)
+		Set(*sync.WaitGroup, Storage, io.Reader, int, *sync.WaitGroup, *chan error, time.Duration)
 		SetReader(io.Reader)
+		SetOptions(Options)
 		Pull(chan error)
-		Flush() error
+		Flush(string, string, io.Writer) error
 		MISPexport() error
+		PlotRange(string, string, string, io.Writer) error
+		Pending() (map[string][]string, error)
+		Janitor() (Reclaimed, error)
+		Bench(int, int) (float64, error)
+		Pairs(string, string, string, int) (map[string][]Member, error)
+	}
+
+	// OptionsChecker is implemented by compilers whose configuration
+	// may not suit some options, e.g. fields that raw lines lack
+	OptionsChecker interface {
+		CheckOptions(Options) error
 	}
 
 	// CompilerStruct will implements Compiler, and should be embedded in
 	// each type implementing compiler
 	CompilerStruct struct {
-		// Compiler redis Read
-		r0 *redis.Conn
-		// Compiler redis Write
-		r1 *redis.Conn
+		// Compiler name, also names the output folder
+		name string
+		// Title of the HTML output
+		title string
+		// Statistics computed by the compiler
+		dimensions []Dimension
+		// Relationships between dimensions counted per day
+		pairs []Pair
+		// Where statistics and raw events are kept
+		store Storage
 		// Input Reader
 		reader io.Reader
 		// Number of line to process before triggering output
@@ -44,6 +65,47 @@ type (
 		comutex
 		// retry Period when applicable
 		retryPeriod time.Duration
+		// Optional settings
+		opts Options
+	}
+
+	// Options holds the optional settings of a compiler
+	Options struct {
+		// Raw makes the compiler parse raw syslog lines
+		// instead of groked JSON
+		Raw bool
+		// Grok makes the compiler grok raw lines itself,
+		// lines matching none of the patterns are skipped
+		Grok grok.Patterns
+		// DeadLetters stores the lines that fail to parse,
+		// they are only logged when nil
+		DeadLetters DeadLetters
+		// Timezones of the loglines without one,
+		// the local timezone when nil
+		Timezones *Timezones
+		// Retention of the data, hourly buckets are
+		// not kept when zero, the rest is kept forever
+		Retention Retention
+	}
+
+	// Dimension is a statistic counted by a compiler,
+	// each one is stored in a stats<Key> sorted set
+	Dimension struct {
+		// Key of the event field to count
+		Key string
+		// Label used in the outputs
+		Label string
+		// Optional dimensions do not count events
+		// missing the field, e.g. the D4 sensor
+		Optional bool
+	}
+
+	// Pair counts, for each value of the From dimension, the values
+	// of the To dimension seen with it, in a daily
+	// <day>:pair<From>-<To>:<From value> sorted set
+	Pair struct {
+		From string
+		To   string
 	}
 
 	comutex struct {
@@ -52,10 +114,9 @@ type (
 	}
 )
 
-// Set set the redis connections to this compiler
-func (s *CompilerStruct) Set(wg *sync.WaitGroup, rconn0 *redis.Conn, rconn1 *redis.Conn, reader io.Reader, ct int, compilegr *sync.WaitGroup, c *chan error, retry time.Duration) {
-	s.r0 = rconn0
-	s.r1 = rconn1
+// Set set the storage of this compiler
+func (s *CompilerStruct) Set(wg *sync.WaitGroup, store Storage, reader io.Reader, ct int, compilegr *sync.WaitGroup, c *chan error, retry time.Duration) {
+	s.store = store
 	s.reader = reader
 	s.compilationTrigger = ct
 	s.compiling = false
@@ -69,17 +130,19 @@ func (s *CompilerStruct) SetReader(reader io.Reader) {
 	s.reader = reader
 }
 
-// tear down is called on error to close redis connections
+// SetOptions changes compiler's optional settings
+func (s *CompilerStruct) SetOptions(o Options) {
+	s.opts = o
+}
+
+// tear down is called on error to close the storage
 // and log errors
 func (s *CompilerStruct) teardown(err error) {
 	*s.pullreturn <- err
-	(*s.r0).Close()
-	(*s.r1).Close()
+	s.store.Close()
 
-	// If the reader is a LPOPReader, we need to teardown the connection
-	switch s.reader.(type) {
-	case *inputreader.RedisLPOPReader:
-		tmp := *s.reader.(*inputreader.RedisLPOPReader)
-		tmp.Teardown()
+	// Readers holding connections need to teardown as well
+	if t, ok := s.reader.(interface{ Teardown() }); ok {
+		t.Teardown()
 	}
 }
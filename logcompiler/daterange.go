@@ -0,0 +1,87 @@
+package logcompiler
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"gonum.org/v1/plot/vg"
+)
+
+const (
+	// Maximum number of days of a date range
+	maxRangeDays = 366
+	// Number of members plotted for a date range
+	maxRangeMembers = 100
+)
+
+// PlotRange writes the SVG bar chart of the statistics of type stype
+// (stats<dimension key>) over the days from from to to, both YYYYMMDD
+// and included. The union of the daily statistics is computed by the
+// storage and cached, for a minute when the range includes today
+func (s *CompilerStruct) PlotRange(from string, to string, stype string, w io.Writer) error {
+	title := ""
+	for _, d := range s.dimensions {
+		if stype == "stats"+d.Key {
+			title = d.Label
+		}
+	}
+	if title == "" {
+		return fmt.Errorf("unknown statistics type %q", stype)
+	}
+	start, err := time.Parse("20060102", from)
+	if err != nil {
+		return fmt.Errorf("invalid start date %q", from)
+	}
+	end, err := time.Parse("20060102", to)
+	if err != nil {
+		return fmt.Errorf("invalid end date %q", to)
+	}
+	if end.Before(start) {
+		start, end = end, start
+	}
+	days := int(end.Sub(start).Hours()/24) + 1
+	if days > maxRangeDays {
+		return fmt.Errorf("date range longer than %v days", maxRangeDays)
+	}
+
+	key := fmt.Sprintf("range:%v-%v:%v", start.Format("20060102"), end.Format("20060102"), stype)
+	exists, err := s.store.Exists(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		keys := make([]string, 0, days)
+		for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+			keys = append(keys, fmt.Sprintf("%v:%v", d.Format("20060102"), stype))
+		}
+		ttl := time.Hour
+		if !end.Before(time.Now().AddDate(0, 0, -1)) {
+			ttl = time.Minute
+		}
+		if err := s.store.Union(key, keys, ttl); err != nil {
+			return err
+		}
+	}
+
+	// Top members, in ascending order as barChart expects
+	top, err := s.store.Top(key, maxRangeMembers)
+	if err != nil {
+		return err
+	}
+	asc := make([]Member, 0, len(top))
+	for i := len(top) - 1; i >= 0; i-- {
+		asc = append(asc, top[i])
+	}
+
+	p, xsize, err := barChart(asc, fmt.Sprintf("%v, %v to %v", title, start.Format("2006-01-02"), end.Format("2006-01-02")))
+	if err != nil {
+		return err
+	}
+	wt, err := p.WriterTo(15*vg.Centimeter, xsize, "svg")
+	if err != nil {
+		return err
+	}
+	_, err = wt.WriteTo(w)
+	return err
+}
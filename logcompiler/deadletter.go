@@ -0,0 +1,285 @@
+package logcompiler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	// DeadLetter is a line a compiler failed to parse
+	DeadLetter struct {
+		Compiler string    `json:"compiler"`
+		Source   string    `json:"source"`
+		Sensor   string    `json:"sensor,omitempty"`
+		Time     time.Time `json:"time"`
+		Error    string    `json:"error"`
+		Line     string    `json:"line"`
+	}
+
+	// DeadLetters stores dead letters until they are re-injected
+	DeadLetters interface {
+		// Push stores a dead letter
+		Push(DeadLetter) error
+		// List returns the dead letters of a compiler, oldest first
+		List(compiler string) ([]DeadLetter, error)
+		// Drain hands the dead letters of a compiler to f, oldest first,
+		// and removes them. It stops at the first error of f, keeping
+		// the dead letter that failed
+		Drain(compiler string, f func(DeadLetter) error) error
+	}
+
+	// RedisDeadLetters stores dead letters in a redis
+	// list per compiler, "<list>:<compiler>"
+	RedisDeadLetters struct {
+		pool *redis.Pool
+		db   int
+		list string
+	}
+
+	// FileDeadLetters appends dead letters to a file, one JSON per line
+	FileDeadLetters struct {
+		mu   sync.Mutex
+		path string
+	}
+)
+
+// NewRedisDeadLetters stores dead letters in database db
+// of the pool, in lists prefixed with list
+func NewRedisDeadLetters(pool *redis.Pool, db int, list string) *RedisDeadLetters {
+	return &RedisDeadLetters{pool: pool, db: db, list: list}
+}
+
+func (rd *RedisDeadLetters) conn() (redis.Conn, error) {
+	c := rd.pool.Get()
+	if _, err := c.Do("SELECT", rd.db); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (rd *RedisDeadLetters) key(compiler string) string {
+	return fmt.Sprintf("%v:%v", rd.list, compiler)
+}
+
+// Push stores a dead letter, newest first
+func (rd *RedisDeadLetters) Push(dl DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	c, err := rd.conn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Do("LPUSH", rd.key(dl.Compiler), b)
+	return err
+}
+
+// List returns the dead letters of a compiler, oldest first
+func (rd *RedisDeadLetters) List(compiler string) ([]DeadLetter, error) {
+	c, err := rd.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	items, err := redis.ByteSlices(c.Do("LRANGE", rd.key(compiler), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	dls := make([]DeadLetter, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		var dl DeadLetter
+		if err := json.Unmarshal(items[i], &dl); err != nil {
+			return nil, err
+		}
+		dls = append(dls, dl)
+	}
+	return dls, nil
+}
+
+// Drain hands the dead letters of a compiler to f, oldest first
+func (rd *RedisDeadLetters) Drain(compiler string, f func(DeadLetter) error) error {
+	c, err := rd.conn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for {
+		item, err := redis.Bytes(c.Do("RPOP", rd.key(compiler)))
+		if err == redis.ErrNil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(item, &dl); err != nil {
+			return err
+		}
+		if err := f(dl); err != nil {
+			// Put it back at the oldest end
+			c.Do("RPUSH", rd.key(compiler), item)
+			return err
+		}
+	}
+}
+
+// NewFileDeadLetters appends dead letters to the file at path
+func NewFileDeadLetters(path string) *FileDeadLetters {
+	return &FileDeadLetters{path: path}
+}
+
+// Push appends a dead letter to the file
+func (fd *FileDeadLetters) Push(dl DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	f, err := os.OpenFile(fd.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readFile returns the dead letters of the file at path
+func readFile(path string) ([]DeadLetter, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var dls []DeadLetter
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		dls = append(dls, dl)
+	}
+	return dls, scanner.Err()
+}
+
+// read returns every dead letter, the ones of an interrupted Drain
+// included, oldest first. Dead letters put back by a Drain follow
+// the ones pushed meanwhile in the file, hence the sort
+func (fd *FileDeadLetters) read() ([]DeadLetter, error) {
+	var all []DeadLetter
+	for _, path := range []string{fd.draining(), fd.path} {
+		dls, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, dls...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Time.Before(all[j].Time)
+	})
+	return all, nil
+}
+
+// draining is where the file is moved while drained
+func (fd *FileDeadLetters) draining() string {
+	return fd.path + ".draining"
+}
+
+// List returns the dead letters of a compiler, oldest first
+func (fd *FileDeadLetters) List(compiler string) ([]DeadLetter, error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	all, err := fd.read()
+	if err != nil {
+		return nil, err
+	}
+	var dls []DeadLetter
+	for _, dl := range all {
+		if dl.Compiler == compiler {
+			dls = append(dls, dl)
+		}
+	}
+	return dls, nil
+}
+
+// Drain hands the dead letters of a compiler to f, oldest first. The
+// file is first renamed aside, so that the dead letters pushed in the
+// meantime, by this process or another one, go to a new file. The
+// dead letters left are appended back to it. A copy left aside by an
+// interrupted Drain is drained first, the file waiting for the next
+// Drain; if it was interrupted after putting dead letters back, these
+// are handed twice. Drains are not meant to run concurrently
+func (fd *FileDeadLetters) Drain(compiler string, f func(DeadLetter) error) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	aside := fd.draining()
+	if _, err := os.Stat(aside); os.IsNotExist(err) {
+		if err := os.Rename(fd.path, aside); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	all, err := readFile(aside)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Time.Before(all[j].Time)
+	})
+
+	var kept bytes.Buffer
+	var ferr error
+	for _, dl := range all {
+		if dl.Compiler == compiler && ferr == nil {
+			if ferr = f(dl); ferr == nil {
+				continue
+			}
+		}
+		b, err := json.Marshal(dl)
+		if err != nil {
+			return err
+		}
+		kept.Write(append(b, '\n'))
+	}
+	if kept.Len() > 0 {
+		// A single write, appended whole
+		w, err := os.OpenFile(fd.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(kept.Bytes()); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(aside); err != nil {
+		return err
+	}
+	return ferr
+}
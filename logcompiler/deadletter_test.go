@@ -0,0 +1,98 @@
+package logcompiler
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fd := NewFileDeadLetters(filepath.Join(dir, "deadletters"))
+	// Another process pushing to the same file
+	live := NewFileDeadLetters(fd.path)
+
+	t0 := time.Date(2020, time.March, 1, 10, 0, 0, 0, time.UTC)
+	push := func(compiler string, line string, minutes int) {
+		t.Helper()
+		if err := live.Push(DeadLetter{Compiler: compiler, Line: line, Time: t0.Add(time.Duration(minutes) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := func(dls []DeadLetter) []string {
+		var l []string
+		for _, dl := range dls {
+			l = append(l, dl.Line)
+		}
+		return l
+	}
+	push("sshd", "a", 0)
+	push("postfix", "p", 1)
+	push("sshd", "b", 2)
+	push("sshd", "c", 3)
+
+	// Dead letters pushed while draining go to a new file, those
+	// not handed are put back, and listed oldest first
+	var drained []string
+	err = fd.Drain("sshd", func(dl DeadLetter) error {
+		if dl.Line == "b" {
+			push("sshd", "d", 4)
+			return errors.New("input down")
+		}
+		drained = append(drained, dl.Line)
+		return nil
+	})
+	if err == nil || err.Error() != "input down" {
+		t.Fatalf("Drain() error = %v, want the error of f", err)
+	}
+	if !reflect.DeepEqual(drained, []string{"a"}) {
+		t.Errorf("drained = %v, want [a]", drained)
+	}
+	dls, err := fd.List("sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lines(dls); !reflect.DeepEqual(got, []string{"b", "c", "d"}) {
+		t.Errorf("List() = %v, want [b c d]", got)
+	}
+	if _, err := os.Stat(fd.draining()); !os.IsNotExist(err) {
+		t.Errorf("%v left after Drain(): %v", fd.draining(), err)
+	}
+
+	// The copy of an interrupted Drain comes first
+	if err := os.Rename(fd.path, fd.draining()); err != nil {
+		t.Fatal(err)
+	}
+	push("sshd", "e", 5)
+	drained = nil
+	collect := func(dl DeadLetter) error {
+		drained = append(drained, dl.Line)
+		return nil
+	}
+	if err := fd.Drain("sshd", collect); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Drain("sshd", collect); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(drained, []string{"b", "c", "d", "e"}) {
+		t.Errorf("drained = %v, want [b c d e]", drained)
+	}
+	if dls, _ := fd.List("postfix"); !reflect.DeepEqual(lines(dls), []string{"p"}) {
+		t.Errorf("dead letters of another compiler = %v", lines(dls))
+	}
+
+	// Nothing to drain
+	empty := NewFileDeadLetters(filepath.Join(dir, "none"))
+	if err := empty.Drain("sshd", collect); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,53 @@
+package logcompiler
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Granularities of the outputs, in the order compile regenerates
+// them. Each one marks what changed, see Batch.Mark
+var granularities = []string{"daily", "weekly", "monthly", "yearly", "distinct", "heatmap"}
+
+// regenerate rebuilds the output member of granularity
+func (s *CompilerStruct) regenerate(granularity string, member string) error {
+	switch granularity {
+	case "daily":
+		if err := s.plotStats(member); err != nil {
+			return err
+		}
+		if err := s.csvStats(member); err != nil {
+			return err
+		}
+		return s.drillDown(member)
+	case "weekly":
+		if err := s.plotStats(member); err != nil {
+			return err
+		}
+		return s.csvStats(member)
+	case "monthly", "yearly":
+		return s.plotStats(member)
+	case "distinct":
+		return s.csvDistinct(member)
+	case "heatmap":
+		return s.plotHeatmap(member)
+	}
+	return fmt.Errorf("unknown granularity %v", granularity)
+}
+
+// Pending returns the outputs waiting to be regenerated,
+// sorted and keyed by granularity
+func (s *CompilerStruct) Pending() (map[string][]string, error) {
+	pending := make(map[string][]string)
+	for _, g := range granularities {
+		members, err := s.store.Marked(g)
+		if err != nil {
+			return nil, err
+		}
+		if len(members) > 0 {
+			sort.Strings(members)
+			pending[g] = members
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,115 @@
+package logcompiler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// distinctCounts returns the distinct counts of the
+// dimensions over a period, in the order of the dimensions
+func (s *CompilerStruct) distinctCounts(period string) ([]int64, error) {
+	counts := make([]int64, len(s.dimensions))
+	for i, d := range s.dimensions {
+		n, err := s.store.Distinct(fmt.Sprintf("%v:distinct%v", period, d.Key))
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = n
+	}
+	return counts, nil
+}
+
+// csvDistinct writes the distinct counts of a period to
+// <period>/<period>:distinct.csv, one dimension per line. Days
+// also get their line in the distinct.csv summary of the compiler
+func (s *CompilerStruct) csvDistinct(period string) error {
+	counts, err := s.distinctCounts(period)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join("data", s.name, period)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file, err := os.Create(filepath.Join(dir, fmt.Sprintf("%v:distinct.csv", period)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for i, d := range s.dimensions {
+		fmt.Fprintf(file, "%s, %d\n", d.Key, counts[i])
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if len(period) != 8 {
+		return nil
+	}
+	return s.summarizeDistinct(period, counts)
+}
+
+// summarizeDistinct sets the line of day in distinct.csv, which
+// holds the distinct counts of every day, oldest first
+func (s *CompilerStruct) summarizeDistinct(day string, counts []int64) error {
+	path := filepath.Join("data", s.name, "distinct.csv")
+	header := "day"
+	for _, d := range s.dimensions {
+		header += ", " + d.Key
+	}
+
+	// Lines of the other days, unless dimensions changed
+	lines := make(map[string]string)
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		if scanner.Scan() && scanner.Text() == header {
+			for scanner.Scan() {
+				l := scanner.Text()
+				lines[strings.SplitN(l, ",", 2)[0]] = l
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	line := day
+	for _, n := range counts {
+		line += fmt.Sprintf(", %d", n)
+	}
+	lines[day] = line
+
+	days := make([]string, 0, len(lines))
+	for d := range lines {
+		days = append(days, d)
+	}
+	sort.Strings(days)
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, header)
+	for _, d := range days {
+		fmt.Fprintln(w, lines[d])
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
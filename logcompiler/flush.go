@@ -0,0 +1,470 @@
+package logcompiler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Value set while a Flush runs, pull waits for it to
+	// be deleted before committing
+	flushLock = "flush:lock"
+	// A lock not refreshed for that long was left by a Flush that
+	// crashed, it is ignored
+	flushLockStale = 10 * time.Minute
+	// Period between two refreshes of the lock
+	flushLockRefresh = time.Minute
+	// Value changed by every commit of pull, for Flush to
+	// tell whether events were counted while it ran
+	committedKey = "committed"
+)
+
+// rebuild is the extent of a Flush: every day, or the days of
+// the whole months and ISO weeks overlapping a date range
+type rebuild struct {
+	all    bool
+	from   string
+	to     string
+	days   map[string]bool
+	weeks  map[string]bool
+	months map[string]bool
+	// First day of the periods rebuilt, when the raw events
+	// of earlier days were deleted and their statistics kept
+	since string
+}
+
+// newRebuild returns the extent of a Flush from from to to, both
+// YYYYMMDD and included, or of everything when both are empty
+func newRebuild(from string, to string) (*rebuild, error) {
+	if from == "" && to == "" {
+		return &rebuild{all: true}, nil
+	}
+	start, err := time.Parse("20060102", from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start date %q", from)
+	}
+	end, err := time.Parse("20060102", to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end date %q", to)
+	}
+	if end.Before(start) {
+		start, end = end, start
+	}
+	r := &rebuild{
+		from:   start.Format("20060102"),
+		to:     end.Format("20060102"),
+		days:   make(map[string]bool),
+		weeks:  make(map[string]bool),
+		months: make(map[string]bool),
+	}
+
+	// Whole months, then whole weeks of these months, so that
+	// their statistics are complete once replayed
+	start = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end = time.Date(end.Year(), end.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		r.months[d.Format("200601")] = true
+	}
+	start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	end = end.AddDate(0, 0, (7-int(end.Weekday()))%7)
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		r.days[d.Format("20060102")] = true
+		year, week := d.ISOWeek()
+		r.weeks[fmt.Sprintf("%vW%02d", year, week)] = true
+	}
+	return r, nil
+}
+
+// String names the extent, to resume the same Flush only
+func (r *rebuild) String() string {
+	if r.all {
+		return "all"
+	}
+	return r.from + "-" + r.to
+}
+
+// includes tells whether the events of day are replayed
+func (r *rebuild) includes(day string) bool {
+	return r.all || r.days[day]
+}
+
+// whole tells whether every statistic is rebuilt, along
+// with the oldest and newest days and the indexes
+func (r *rebuild) whole() bool {
+	return r.all && r.since == ""
+}
+
+// filter tells whether the key is rebuilt. Periods starting before
+// since are kept. Yearly statistics are not replayed unless the
+// rebuild is whole, they are summed from the months
+func (r *rebuild) filter(key string) bool {
+	if strings.HasPrefix(key, "range:") {
+		return true
+	}
+	if _, ok := indexes[key]; ok {
+		return r.whole()
+	}
+	p := periodOf(key)
+	if p == "" {
+		return r.whole() && (key == "oldest" || key == "newest")
+	}
+	if r.since != "" && periodStart(p) < r.since {
+		return false
+	}
+	switch {
+	case r.all:
+		return r.whole() || len(p) != 4
+	case len(p) == 8 || len(p) == 10:
+		return r.days[p[:8]]
+	case strings.Contains(p, "W"):
+		return r.weeks[p]
+	case len(p) == 6:
+		return r.months[p]
+	}
+	return false
+}
+
+// periodOf returns the period of a statistics, distinct
+// counts, pairs or heatmap key, "" for other keys
+func periodOf(key string) string {
+	kk := strings.SplitN(key, ":", 2)
+	if len(kk) != 2 {
+		return ""
+	}
+	for _, t := range []string{"stats", "distinct", "pair", "heatmap"} {
+		if strings.HasPrefix(kk[1], t) {
+			return kk[0]
+		}
+	}
+	return ""
+}
+
+// periodStart returns the first day of the period p, YYYYMMDD
+func periodStart(p string) string {
+	switch {
+	case strings.Contains(p, "W"):
+		var year, week int
+		if _, err := fmt.Sscanf(p, "%dW%d", &year, &week); err != nil {
+			return p
+		}
+		// January 4th is in the first ISO week
+		d := time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC)
+		d = d.AddDate(0, 0, (week-1)*7-(int(d.Weekday())+6)%7)
+		return d.Format("20060102")
+	case len(p) >= 8:
+		return p[:8]
+	case len(p) == 6:
+		return p + "01"
+	case len(p) == 4:
+		return p + "0101"
+	}
+	return p
+}
+
+// Flush recomputes the statistics from the raw events, from from to
+// to (YYYYMMDD) or all of them when both are empty. They are rebuilt
+// in the staging namespace of the storage, a day at a time, and
+// swapped in once complete. A Flush that failed resumes from its last
+// day when run again on the same range, unless events were counted
+// meanwhile. Progress is written to progress.
+//
+// Analyzers running on the storage wait for the Flush to complete
+// before committing, the Flush fails if events were counted anyway
+func (s *CompilerStruct) Flush(from string, to string, progress io.Writer) error {
+	r, err := newRebuild(from, to)
+	if err != nil {
+		return err
+	}
+	staging, err := s.store.Staging()
+	if err != nil {
+		return err
+	}
+	if err := s.lockFlush(); err != nil {
+		return err
+	}
+	defer s.store.Delete(flushLock)
+	locked := time.Now()
+	committed, err := s.store.Get(committedKey)
+	if err != nil {
+		return err
+	}
+
+	// Resume the rebuild of the same extent, or start over
+	done, err := staging.Get("flush:done")
+	if err != nil {
+		return err
+	}
+	extent, err := staging.Get("flush:extent")
+	if err != nil {
+		return err
+	}
+	since, err := staging.Get("flush:committed")
+	if err != nil {
+		return err
+	}
+	if extent != r.String() || since != committed {
+		if extent == r.String() && done != "" {
+			fmt.Fprintf(progress, "%v: events were counted since the rebuild stopped, starting over\n", s.name)
+		}
+		if err := staging.Flush(); err != nil {
+			return err
+		}
+		if err := staging.Set("flush:extent", r.String()); err != nil {
+			return err
+		}
+		if err := staging.Set("flush:committed", committed); err != nil {
+			return err
+		}
+		done = ""
+	} else if done != "" {
+		fmt.Fprintf(progress, "%v: resuming after %v\n", s.name, done)
+	}
+	log.Printf("%v: flushing %v", s.name, r)
+
+	all, err := s.store.Days()
+	if err != nil {
+		return err
+	}
+	var days []string
+	for _, d := range all {
+		// "legacy" sorts after every day
+		if r.includes(d) && d > done {
+			days = append(days, d)
+		}
+	}
+	sort.Strings(days)
+
+	// Each day is committed along with its progress
+	for i, d := range days {
+		b := NewBatch()
+		err := s.replayDay(d, func(t time.Time, fields map[string]string) error {
+			s.compileStats(b, t, fields)
+			if time.Since(locked) < flushLockRefresh {
+				return nil
+			}
+			locked = time.Now()
+			return s.lockFlush()
+		})
+		if err != nil {
+			return err
+		}
+		b.Set("flush:done", d)
+		if err := staging.Commit(b); err != nil {
+			return err
+		}
+		fmt.Fprintf(progress, "%v: %v/%v days, %v: %v events\n", s.name, i+1, len(days), d, b.Len())
+	}
+
+	// Loglines stored by previous versions, by second and host
+	if l, ok := s.store.(legacyEvents); ok && done != "legacy" {
+		b := NewBatch()
+		err := l.ReplayLegacy(func(t time.Time, fields map[string]string) error {
+			if r.includes(t.Format("20060102")) {
+				s.compileStats(b, t, fields)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		b.Set("flush:done", "legacy")
+		if err := staging.Commit(b); err != nil {
+			return err
+		}
+		if b.Len() > 0 {
+			fmt.Fprintf(progress, "%v: %v legacy events\n", s.name, b.Len())
+		}
+	}
+
+	// The janitor deletes raw events from the oldest day on: the
+	// periods starting before the first day left keep their
+	// statistics, which cannot be recomputed
+	first, err := staging.Get("oldest")
+	if err != nil {
+		return err
+	}
+	for _, d := range all {
+		if d != "legacy" && (first == "" || d < first) {
+			first = d
+		}
+	}
+	if oldest, err := s.store.Get("oldest"); err != nil {
+		return err
+	} else if oldest != "" && (first == "" || oldest < first) {
+		r.since = first
+		if first == "" {
+			// No raw event left, everything is kept
+			r.since = "99999999"
+		}
+		fmt.Fprintf(progress, "%v: no raw events before %v, statistics of the periods starting earlier are kept\n", s.name, first)
+	}
+
+	// Periods rebuilt for a range, or after periods kept, extend
+	// the oldest and newest days and the indexes
+	span := NewBatch()
+	years := make(map[string]bool)
+	for m := range r.months {
+		years[m[:4]] = true
+	}
+	if !r.whole() {
+		for _, k := range []string{"oldest", "newest"} {
+			d, err := staging.Get(k)
+			if err != nil {
+				return err
+			}
+			if d != "" {
+				span.Count(d)
+			}
+		}
+		for index := range indexes {
+			periods, err := staging.Members(index)
+			if err != nil {
+				return err
+			}
+			for _, p := range periods {
+				span.Index(index, p.Name)
+				if index == yearIndex {
+					years[p.Name] = true
+				}
+			}
+		}
+	}
+
+	// Events counted by an analyzer ignoring the lock
+	// are missing from the rebuilt statistics
+	if c, err := s.store.Get(committedKey); err != nil {
+		return err
+	} else if c != committed {
+		return fmt.Errorf("events were counted during the rebuild, it has to be run again")
+	}
+	// A Swap failing midway leaves staging incomplete, a
+	// Flush run again has to start over
+	if err := staging.Delete("flush:extent"); err != nil {
+		return err
+	}
+	swapped, err := s.store.Swap(staging, r.filter)
+	if err != nil {
+		return err
+	}
+	for _, k := range swapped {
+		markRebuilt(span, k)
+	}
+	if !r.whole() {
+		if err := s.sumYears(span, years); err != nil {
+			return err
+		}
+	}
+	if err := s.store.Commit(span); err != nil {
+		return err
+	}
+	fmt.Fprintf(progress, "%v: %v keys rebuilt\n", s.name, len(swapped))
+	log.Printf("%v: flushed %v, %v keys rebuilt", s.name, r, len(swapped))
+	return nil
+}
+
+// lockFlush takes or refreshes the lock of a Flush
+func (s *CompilerStruct) lockFlush() error {
+	return s.store.Set(flushLock, time.Now().UTC().Format(time.RFC3339))
+}
+
+// flushLocked tells whether a Flush holds its lock
+func (s *CompilerStruct) flushLocked() (bool, error) {
+	v, err := s.store.Get(flushLock)
+	if err != nil || v == "" {
+		return false, err
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %v: %q", flushLock, v)
+	}
+	return time.Since(t) < flushLockStale, nil
+}
+
+// waitFlush waits for a running Flush to complete
+func (s *CompilerStruct) waitFlush() error {
+	for waited := false; ; waited = true {
+		locked, err := s.flushLocked()
+		if err != nil {
+			return err
+		}
+		if !locked {
+			if waited {
+				log.Printf("%v: statistics rebuilt, resuming", s.name)
+			}
+			return nil
+		}
+		if !waited {
+			log.Printf("%v: waiting for the statistics to be rebuilt", s.name)
+		}
+		time.Sleep(pullPeriod)
+	}
+}
+
+// sumYears recomputes the yearly statistics, distinct counts
+// and heatmaps of years from their months
+func (s *CompilerStruct) sumYears(b *Batch, years map[string]bool) error {
+	for y := range years {
+		for _, d := range s.dimensions {
+			for _, t := range []string{"stats", "distinct"} {
+				months, err := s.store.Keys(fmt.Sprintf("%v??:%v%v", y, t, d.Key))
+				if err != nil {
+					return err
+				}
+				if err := s.sum(fmt.Sprintf("%v:%v%v", y, t, d.Key), t, months); err != nil {
+					return err
+				}
+				if t == "stats" && len(months) > 0 {
+					b.Mark("yearly", fmt.Sprintf("%v:stats%v", y, d.Key))
+				}
+			}
+		}
+		months, err := s.store.Keys(y + "??:heatmap")
+		if err != nil {
+			return err
+		}
+		if err := s.sum(y+":heatmap", "stats", months); err != nil {
+			return err
+		}
+		b.Mark("distinct", y)
+		b.Mark("heatmap", y)
+	}
+	return nil
+}
+
+// sum sets dest to the union of keys, sorted sets or distinct counts
+func (s *CompilerStruct) sum(dest string, t string, keys []string) error {
+	if len(keys) == 0 {
+		return s.store.Delete(dest)
+	}
+	if t == "distinct" {
+		return s.store.Merge(dest, keys)
+	}
+	return s.store.Union(dest, keys, 0)
+}
+
+// markRebuilt marks the outputs of a rebuilt key for regeneration
+func markRebuilt(b *Batch, key string) {
+	p := periodOf(key)
+	switch {
+	case p == "" || len(p) == 10:
+	case strings.Contains(key, ":heatmap"):
+		b.Mark("heatmap", p)
+	case strings.Contains(key, ":distinct"):
+		b.Mark("distinct", p)
+	case strings.Contains(key, ":stats"):
+		switch {
+		case strings.Contains(p, "W"):
+			b.Mark("weekly", key)
+		case len(p) == 8:
+			b.Mark("daily", key)
+		case len(p) == 6:
+			b.Mark("monthly", key)
+		case len(p) == 4:
+			b.Mark("yearly", key)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package logcompiler
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keysOf returns the sorted keys of m
+func keysOf(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestNewRebuild(t *testing.T) {
+	r, err := newRebuild("", "")
+	if err != nil || !r.all || r.String() != "all" {
+		t.Fatalf("newRebuild() of everything = %+v, %v", r, err)
+	}
+
+	// March 2020 starts on a Sunday and ends on a Tuesday, its
+	// weeks run from Monday Feb 24 to Sunday Apr 5
+	r, err = newRebuild("20200312", "20200303")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != "20200303-20200312" {
+		t.Errorf("String() = %v, want the range in order", r)
+	}
+	if months := keysOf(r.months); !reflect.DeepEqual(months, []string{"202003"}) {
+		t.Errorf("months = %v", months)
+	}
+	if weeks := keysOf(r.weeks); !reflect.DeepEqual(weeks, []string{"2020W09", "2020W10", "2020W11", "2020W12", "2020W13", "2020W14"}) {
+		t.Errorf("weeks = %v", weeks)
+	}
+	days := keysOf(r.days)
+	if len(days) != 42 || days[0] != "20200224" || days[41] != "20200405" {
+		t.Errorf("days = %v ... %v (%v days), want 20200224 ... 20200405", days[0], days[len(days)-1], len(days))
+	}
+
+	// Weeks over the turn of the year
+	r, err = newRebuild("20201231", "20210101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if months := keysOf(r.months); !reflect.DeepEqual(months, []string{"202012", "202101"}) {
+		t.Errorf("months = %v", months)
+	}
+	if !r.weeks["2020W53"] || !r.days["20201130"] || !r.days["20210131"] || r.days["20210201"] {
+		t.Errorf("weeks = %v, days %v ... %v", keysOf(r.weeks), keysOf(r.days)[0], keysOf(r.days)[len(r.days)-1])
+	}
+
+	for _, bad := range [][2]string{{"2020-03-01", "20200302"}, {"20200301", ""}, {"", "20200301"}} {
+		if _, err := newRebuild(bad[0], bad[1]); err == nil {
+			t.Errorf("newRebuild(%q, %q) should fail", bad[0], bad[1])
+		}
+	}
+}
+
+func TestRebuildFilter(t *testing.T) {
+	r, err := newRebuild("20200303", "20200312")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := newRebuild("", "")
+	tests := []struct {
+		key      string
+		rebuilt  bool
+		wholeRun bool
+	}{
+		{"20200301:statssrc", true, true},
+		{"2020030110:statssrc", true, true},
+		{"20200224:pairsrc-username:1.2.3.4", true, true},
+		{"20200406:statssrc", false, true},
+		{"202003:distinctsrc", true, true},
+		{"202004:heatmap", false, true},
+		{"2020W14:statsusername", true, true},
+		{"2020W15:statsusername", false, true},
+		// Years are summed from their months
+		{"2020:statssrc", false, true},
+		{"range:20200301-20200307:statssrc", true, true},
+		{"oldest", false, true},
+		{"flush:done", false, false},
+	}
+	for _, tt := range tests {
+		if got := r.filter(tt.key); got != tt.rebuilt {
+			t.Errorf("filter(%q) = %v, want %v", tt.key, got, tt.rebuilt)
+		}
+		if got := all.filter(tt.key); got != tt.wholeRun {
+			t.Errorf("filter(%q) of everything = %v, want %v", tt.key, got, tt.wholeRun)
+		}
+	}
+}
+
+// newTestCompiler returns a compiler counting sources and
+// usernames, on a scratch bolt storage
+func newTestCompiler(t *testing.T) (*CompilerStruct, *BoltStorage, func()) {
+	t.Helper()
+	bs, done := newTestBolt(t, "web")
+	g := newTestGeneric(t, GenericConfig{
+		Name:   "web",
+		Fields: map[string]string{"timestamp": "ts", "src": "ip", "username": "user"},
+	})
+	s := &g.CompilerStruct
+	s.store = bs
+	return s, bs, done
+}
+
+// count counts events as pull does, their raw events stored
+func count(t *testing.T, s *CompilerStruct, events ...rawEvent) {
+	t.Helper()
+	commit(t, s.store, func(b *Batch) {
+		for _, re := range events {
+			if err := s.storeEvent(b, &event{time: re.Time, fields: re.Fields}, nil); err != nil {
+				t.Fatal(err)
+			}
+			s.compileStats(b, re.Time, re.Fields)
+		}
+	})
+}
+
+func at(day string) time.Time {
+	t, _ := time.Parse("20060102", day)
+	return t.Add(10 * time.Hour)
+}
+
+// expectTop checks the members of the statistics key, highest first
+func expectTop(t *testing.T, s Storage, key string, want ...Member) {
+	t.Helper()
+	top, err := s.Top(key, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 0 || len(want) != 0 {
+		if !reflect.DeepEqual(top, want) {
+			t.Errorf("%v = %v, want %v", key, top, want)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	s, bs, done := newTestCompiler(t)
+	defer done()
+
+	count(t, s,
+		rawEvent{Time: at("20200301"), Fields: map[string]string{"src": "1.2.3.4", "username": "root"}},
+		rawEvent{Time: at("20200301"), Fields: map[string]string{"src": "1.2.3.4", "username": "admin"}},
+		rawEvent{Time: at("20200415"), Fields: map[string]string{"src": "5.6.7.8", "username": "root"}},
+	)
+	// Statistics drifting from the raw events
+	commit(t, bs, func(b *Batch) {
+		b.Incr("20200301:statssrc", "9.9.9.9", time.Time{})
+		b.Incr("20200415:statssrc", "9.9.9.9", time.Time{})
+		b.Incr("2020:statssrc", "9.9.9.9", time.Time{})
+		b.Incr("20190101:statssrc", "9.9.9.9", time.Time{})
+	})
+	for _, g := range granularities {
+		if _, err := bs.Take(g); err != nil {
+			t.Fatal(err)
+		}
+		bs.Clear(g)
+	}
+
+	// A range only rebuilds the days, weeks and months
+	// overlapping it, years are summed from the months
+	var progress bytes.Buffer
+	if err := s.Flush("20200301", "20200301", &progress); err != nil {
+		t.Fatal(err)
+	}
+	expectTop(t, bs, "20200301:statssrc", Member{"1.2.3.4", 2})
+	expectTop(t, bs, "202003:statssrc", Member{"1.2.3.4", 2})
+	expectTop(t, bs, "20200415:statssrc", Member{"9.9.9.9", 1}, Member{"5.6.7.8", 1})
+	expectTop(t, bs, "2020:statssrc", Member{"1.2.3.4", 2}, Member{"5.6.7.8", 1})
+	marked, _ := bs.Marked("daily")
+	sort.Strings(marked)
+	if !reflect.DeepEqual(marked, []string{"20200301:statssrc", "20200301:statsusername"}) {
+		t.Errorf("daily markers = %v", marked)
+	}
+	if marked, _ = bs.Marked("yearly"); len(marked) == 0 {
+		t.Error("the yearly outputs are not marked")
+	}
+
+	// Everything is rebuilt from the raw events
+	if err := s.Flush("", "", &progress); err != nil {
+		t.Fatal(err)
+	}
+	expectTop(t, bs, "20200415:statssrc", Member{"5.6.7.8", 1})
+	expectTop(t, bs, "2020:statssrc", Member{"1.2.3.4", 2}, Member{"5.6.7.8", 1})
+	expectTop(t, bs, "20190101:statssrc")
+	if oldest, _ := bs.Get("oldest"); oldest != "20200301" {
+		t.Errorf("oldest = %v, want 20200301", oldest)
+	}
+	if n, err := bs.Distinct("2020:distinctusername"); err != nil || n != 2 {
+		t.Errorf("distinct usernames of 2020 = %v, %v, want 2", n, err)
+	}
+
+	// The staging namespace is dropped once swapped in
+	staging, err := bs.Staging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := staging.Keys("*"); len(keys) != 0 {
+		t.Errorf("staging left with %v", keys)
+	}
+}
+
+func TestFlushResume(t *testing.T) {
+	s, bs, done := newTestCompiler(t)
+	defer done()
+
+	count(t, s,
+		rawEvent{Time: at("20200301"), Fields: map[string]string{"src": "1.2.3.4", "username": "root"}},
+		rawEvent{Time: at("20200302"), Fields: map[string]string{"src": "5.6.7.8", "username": "root"}},
+	)
+
+	// A Flush of everything that stopped after its first day
+	staging, err := bs.Staging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(t, staging, func(b *Batch) {
+		s.compileStats(b, at("20200301"), map[string]string{"src": "1.2.3.4", "username": "root"})
+		b.Set("flush:extent", "all")
+		b.Set("flush:done", "20200301")
+	})
+
+	var progress bytes.Buffer
+	if err := s.Flush("", "", &progress); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(progress.String(), "resuming after 20200301") || !strings.Contains(progress.String(), "1/1 days") {
+		t.Errorf("progress = %q, want the Flush resumed with one day", progress.String())
+	}
+	expectTop(t, bs, "202003:statssrc", Member{"5.6.7.8", 1}, Member{"1.2.3.4", 1})
+
+	// The staging of another extent is started over
+	if staging, err = bs.Staging(); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, staging, func(b *Batch) {
+		b.Incr("20200301:statssrc", "9.9.9.9", time.Time{})
+		b.Set("flush:extent", "20200101-20200131")
+		b.Set("flush:done", "20200301")
+	})
+	progress.Reset()
+	if err := s.Flush("", "", &progress); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(progress.String(), "resuming") {
+		t.Errorf("progress = %q, want a new Flush", progress.String())
+	}
+	expectTop(t, bs, "20200301:statssrc", Member{"1.2.3.4", 1})
+}
+
+// committingWriter counts an event in the live statistics on
+// the first progress written, as an analyzer ignoring the lock
+type committingWriter struct {
+	bytes.Buffer
+	store Storage
+}
+
+func (w *committingWriter) Write(p []byte) (int, error) {
+	if w.store != nil {
+		if err := w.store.Set(committedKey, "1"); err != nil {
+			return 0, err
+		}
+		w.store = nil
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestFlushLock(t *testing.T) {
+	s, bs, done := newTestCompiler(t)
+	defer done()
+
+	count(t, s,
+		rawEvent{Time: at("20200301"), Fields: map[string]string{"src": "1.2.3.4", "username": "root"}},
+		rawEvent{Time: at("20200302"), Fields: map[string]string{"src": "5.6.7.8", "username": "root"}},
+	)
+
+	// Events counted during the Flush fail it, and are
+	// counted by the Flush run again, started over
+	progress := &committingWriter{store: bs}
+	if err := s.Flush("", "", progress); err == nil {
+		t.Fatal("Flush() with events counted meanwhile should fail")
+	}
+	count(t, s, rawEvent{Time: at("20200301"), Fields: map[string]string{"src": "9.9.9.9", "username": "root"}})
+	if err := s.Flush("", "", progress); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(progress.String(), "starting over") {
+		t.Errorf("progress = %q, want the Flush started over", progress.String())
+	}
+	expectTop(t, bs, "20200301:statssrc", Member{"9.9.9.9", 1}, Member{"1.2.3.4", 1})
+
+	// The lock is released, and ignored once stale
+	if locked, err := s.flushLocked(); err != nil || locked {
+		t.Errorf("flushLocked() = %v, %v after Flush, want false", locked, err)
+	}
+	if err := s.lockFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := s.flushLocked(); err != nil || !locked {
+		t.Errorf("flushLocked() = %v, %v, want true", locked, err)
+	}
+	if err := bs.Set(flushLock, time.Now().Add(-flushLockStale).UTC().Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := s.flushLocked(); err != nil || locked {
+		t.Errorf("flushLocked() = %v, %v with a stale lock, want false", locked, err)
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	tests := []struct {
+		period string
+		want   string
+	}{
+		{"20200301", "20200301"},
+		{"2020030110", "20200301"},
+		{"202003", "20200301"},
+		{"2020", "20200101"},
+		{"2020W01", "20191230"},
+		{"2020W10", "20200302"},
+		{"2020W53", "20201228"},
+		{"2021W01", "20210104"},
+	}
+	for _, tt := range tests {
+		if got := periodStart(tt.period); got != tt.want {
+			t.Errorf("periodStart(%v) = %v, want %v", tt.period, got, tt.want)
+		}
+	}
+}
+
+func TestFlushDeletedRaw(t *testing.T) {
+	s, bs, done := newTestCompiler(t)
+	defer done()
+
+	count(t, s,
+		rawEvent{Time: at("20200115"), Fields: map[string]string{"src": "1.2.3.4", "username": "root"}},
+		rawEvent{Time: at("20200304"), Fields: map[string]string{"src": "5.6.7.8", "username": "root"}},
+		rawEvent{Time: at("20200310"), Fields: map[string]string{"src": "5.6.7.8", "username": "admin"}},
+	)
+	// Deleted by the janitor
+	if _, err := bs.DeleteDay("20200115"); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress bytes.Buffer
+	if err := s.Flush("", "", &progress); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(progress.String(), "no raw events before 20200304") {
+		t.Errorf("progress = %q", progress.String())
+	}
+	// Periods starting before the first raw event are kept, as is
+	// the week of Monday Mar 2, years are summed from the months
+	expectTop(t, bs, "20200115:statssrc", Member{"1.2.3.4", 1})
+	expectTop(t, bs, "202001:statssrc", Member{"1.2.3.4", 1})
+	expectTop(t, bs, "2020W10:statssrc", Member{"5.6.7.8", 1})
+	expectTop(t, bs, "2020W11:statssrc", Member{"5.6.7.8", 1})
+	expectTop(t, bs, "202003:statssrc", Member{"5.6.7.8", 2})
+	expectTop(t, bs, "2020:statssrc", Member{"5.6.7.8", 2}, Member{"1.2.3.4", 1})
+	if oldest, _ := bs.Get("oldest"); oldest != "20200115" {
+		t.Errorf("oldest = %v, want the day kept", oldest)
+	}
+	if days, _ := s.periods(dayIndex); !reflect.DeepEqual(days, []string{"20200115", "20200304", "20200310"}) {
+		t.Errorf("days indexed = %v", days)
+	}
+
+	// With no raw event left, everything is kept
+	for _, d := range []string{"20200304", "20200310"} {
+		bs.DeleteDay(d)
+	}
+	if err := s.Flush("", "", &progress); err != nil {
+		t.Fatal(err)
+	}
+	expectTop(t, bs, "202003:statssrc", Member{"5.6.7.8", 2})
+	expectTop(t, bs, "2020:statssrc", Member{"5.6.7.8", 2}, Member{"1.2.3.4", 1})
+}
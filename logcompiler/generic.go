@@ -0,0 +1,289 @@
+package logcompiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/D4-project/analyzer-d4-log/logparser"
+)
+
+type (
+	// GenericCompiler compiles statistics for any groked JSON logline,
+	// its behavior is described by a GenericConfig
+	GenericCompiler struct {
+		CompilerStruct
+		config GenericConfig
+	}
+
+	// GenericConfig describes a GenericCompiler. It is read from
+	// <configuration directory>/compilers/<name>.json
+	GenericConfig struct {
+		// Name of the compiler, defaults to the file name
+		Name string `json:"name"`
+		// Short description listed by -l
+		Description string `json:"description"`
+		// Title of the HTML output
+		Title string `json:"title"`
+		// Maps event fields to the groked JSON fields. The
+		// "timestamp" field is mandatory, "src", "username" and
+		// "host" are the usual ones
+		Fields map[string]string `json:"fields"`
+		// Go time layout of the timestamp field,
+		// defaults to BSD syslog "Jan 2 15:04:05"
+		TimestampLayout string `json:"timestamp_layout"`
+		// Event fields to count, defaults to src, username and host
+		// when they are mapped. "sensor" counts D4 sensors
+		Dimensions []string `json:"dimensions"`
+		// Counted dimensions whose field may be missing, events
+		// lacking it are not counted in them. Events missing the
+		// field of another dimension are set aside as dead letters
+		Optional []string `json:"optional"`
+		// Labels of the dimensions in the outputs
+		Labels map[string]string `json:"labels"`
+		// Relationships counted per day, as [from, to] dimensions,
+		// defaults to src to username, username to src and src
+		// to host when they are counted
+		Pairs [][2]string `json:"pairs"`
+		// Type of the MISP objects to export, no export when empty
+		MISPType string `json:"misp_type"`
+		// Only raw syslog lines from this program are counted,
+		// all of them when empty
+		Program string `json:"program"`
+	}
+)
+
+var (
+	// Default labels of the usual dimensions
+	defaultLabels = map[string]string{
+		"src":      "Sources",
+		"username": "Usernames",
+		"host":     "Hosts",
+		"sensor":   "Sensors",
+		"source":   "Inputs",
+	}
+
+	// Dimensions filled by the input rather than by the logline,
+	// they are optional
+	inputDimensions = map[string]bool{
+		"sensor": true,
+		"source": true,
+	}
+)
+
+// LoadGenericCompilers registers a GenericCompiler for
+// each .json file found in dir. A missing dir is not an error.
+func LoadGenericCompilers(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		var c GenericConfig
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("%v: %v", f, err)
+		}
+		if c.Name == "" {
+			c.Name = strings.TrimSuffix(filepath.Base(f), ".json")
+		}
+		if err := c.check(); err != nil {
+			return fmt.Errorf("%v: %v", f, err)
+		}
+		if IsRegistered(c.Name) {
+			return fmt.Errorf("%v: compiler %v already exists", f, c.Name)
+		}
+		cfg := c
+		Register(c.Name, c.Description, func() Compiler {
+			return newGenericCompiler(cfg)
+		})
+	}
+	return nil
+}
+
+// check validates the configuration and fills in the defaults
+func (c *GenericConfig) check() error {
+	if strings.ContainsAny(c.Name, ":,"+string(os.PathSeparator)) {
+		return fmt.Errorf("invalid compiler name %q", c.Name)
+	}
+	if c.Fields["timestamp"] == "" {
+		return fmt.Errorf("missing timestamp field mapping")
+	}
+	if c.TimestampLayout == "" {
+		c.TimestampLayout = "Jan 2 15:04:05"
+	}
+	if c.Title == "" {
+		c.Title = c.Name
+	}
+	if len(c.Dimensions) == 0 {
+		for _, d := range []string{"username", "src", "host"} {
+			if c.Fields[d] != "" {
+				c.Dimensions = append(c.Dimensions, d)
+			}
+		}
+	}
+	if len(c.Dimensions) == 0 {
+		return fmt.Errorf("no dimension to count")
+	}
+	counted := make(map[string]bool)
+	for _, d := range c.Dimensions {
+		if d == "timestamp" || (c.Fields[d] == "" && !inputDimensions[d]) {
+			return fmt.Errorf("dimension %q is not mapped to a field", d)
+		}
+		counted[d] = true
+	}
+	for _, d := range c.Optional {
+		if !counted[d] {
+			return fmt.Errorf("optional dimension %q is not counted", d)
+		}
+	}
+	if c.Pairs == nil {
+		for _, p := range [][2]string{{"src", "username"}, {"username", "src"}, {"src", "host"}} {
+			if counted[p[0]] && counted[p[1]] {
+				c.Pairs = append(c.Pairs, p)
+			}
+		}
+	}
+	for _, p := range c.Pairs {
+		if !counted[p[0]] || !counted[p[1]] || p[0] == p[1] {
+			return fmt.Errorf("pair %q is not made of two counted dimensions", p)
+		}
+	}
+	return nil
+}
+
+func newGenericCompiler(c GenericConfig) *GenericCompiler {
+	optional := make(map[string]bool)
+	for _, d := range c.Optional {
+		optional[d] = true
+	}
+	dims := make([]Dimension, 0, len(c.Dimensions))
+	for _, d := range c.Dimensions {
+		label := c.Labels[d]
+		if label == "" {
+			label = defaultLabels[d]
+		}
+		if label == "" {
+			label = d
+		}
+		dims = append(dims, Dimension{Key: d, Label: label, Optional: inputDimensions[d] || optional[d]})
+	}
+	pairs := make([]Pair, 0, len(c.Pairs))
+	for _, p := range c.Pairs {
+		pairs = append(pairs, Pair{From: p[0], To: p[1]})
+	}
+	return &GenericCompiler{
+		CompilerStruct: CompilerStruct{
+			name:       c.Name,
+			title:      c.Title,
+			dimensions: dims,
+			pairs:      pairs,
+		},
+		config: c,
+	}
+}
+
+// Pull pulls groked JSON loglines from the reader
+func (s *GenericCompiler) Pull(c chan error) {
+	s.pull(s.parse)
+}
+
+// parse maps a groked JSON logline to an event following the configuration,
+// raw syslog lines provide the syslog_* fields, groked lines the captured ones
+func (s *GenericCompiler) parse(line []byte) (*event, error) {
+	var m map[string]interface{}
+	if len(s.opts.Grok) > 0 {
+		fields := s.opts.Grok.Match(line)
+		if fields == nil {
+			return nil, nil
+		}
+		m = make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			m[k] = v
+		}
+	} else if s.opts.Raw {
+		l, err := logparser.ParseSyslog(line)
+		if err != nil {
+			return nil, err
+		}
+		if s.config.Program != "" && l.Program != s.config.Program {
+			return nil, nil
+		}
+		m = map[string]interface{}{
+			"syslog_timestamp": l.Timestamp,
+			"syslog_hostname":  l.Hostname,
+			"syslog_program":   l.Program,
+			"syslog_pid":       l.Pid,
+			"syslog_message":   l.Message,
+		}
+	} else {
+		d := json.NewDecoder(strings.NewReader(string(line)))
+		d.UseNumber()
+		if err := d.Decode(&m); err != nil {
+			return nil, err
+		}
+	}
+
+	e := &event{layout: s.config.TimestampLayout, fields: make(map[string]string)}
+	for k, f := range s.config.Fields {
+		v, ok := m[f]
+		if !ok || v == nil {
+			continue
+		}
+		if k == "timestamp" {
+			e.timestamp = fmt.Sprint(v)
+			continue
+		}
+		e.fields[k] = fmt.Sprint(v)
+	}
+	for _, d := range s.dimensions {
+		if !d.Optional && e.fields[d.Key] == "" {
+			return nil, fmt.Errorf("missing %v field %q", d.Key, s.config.Fields[d.Key])
+		}
+	}
+	return e, nil
+}
+
+// rawFields are the fields of raw syslog lines
+var rawFields = map[string]bool{
+	"syslog_timestamp": true,
+	"syslog_hostname":  true,
+	"syslog_program":   true,
+	"syslog_pid":       true,
+	"syslog_message":   true,
+}
+
+// CheckOptions tells whether raw syslog lines provide the fields of the
+// timestamp and of the dimensions, when they are not groked
+func (s *GenericCompiler) CheckOptions(o Options) error {
+	if !o.Raw || len(o.Grok) > 0 {
+		return nil
+	}
+	fields := []string{s.config.Fields["timestamp"]}
+	for _, d := range s.dimensions {
+		if !inputDimensions[d.Key] {
+			fields = append(fields, s.config.Fields[d.Key])
+		}
+	}
+	for _, f := range fields {
+		if !rawFields[f] {
+			return fmt.Errorf("field %q is not provided by raw syslog lines, grok them with -grok", f)
+		}
+	}
+	return nil
+}
+
+// MISPexport pushes the daily top usernames and sources
+// as MISP objects when a MISP type is configured
+func (s *GenericCompiler) MISPexport() error {
+	if s.config.MISPType == "" {
+		return nil
+	}
+	return s.mispExport(s.config.MISPType)
+}
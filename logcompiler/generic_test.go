@@ -0,0 +1,311 @@
+package logcompiler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/D4-project/analyzer-d4-log/grok"
+)
+
+func TestGenericConfigCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  GenericConfig
+		want    GenericConfig
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			config: GenericConfig{
+				Name:   "postfix",
+				Fields: map[string]string{"timestamp": "ts", "src": "client_ip", "username": "sasl_username"},
+			},
+			want: GenericConfig{
+				Name:            "postfix",
+				Title:           "postfix",
+				Fields:          map[string]string{"timestamp": "ts", "src": "client_ip", "username": "sasl_username"},
+				TimestampLayout: "Jan 2 15:04:05",
+				Dimensions:      []string{"username", "src"},
+				Pairs:           [][2]string{{"src", "username"}, {"username", "src"}},
+			},
+		},
+		{
+			name: "explicit settings",
+			config: GenericConfig{
+				Name:            "web",
+				Title:           "Web logins",
+				Fields:          map[string]string{"timestamp": "ts", "src": "ip", "host": "vhost"},
+				TimestampLayout: "2006-01-02 15:04:05",
+				Dimensions:      []string{"host"},
+			},
+			want: GenericConfig{
+				Name:            "web",
+				Title:           "Web logins",
+				Fields:          map[string]string{"timestamp": "ts", "src": "ip", "host": "vhost"},
+				TimestampLayout: "2006-01-02 15:04:05",
+				Dimensions:      []string{"host"},
+			},
+		},
+		{
+			name: "input dimensions need no field",
+			config: GenericConfig{
+				Name:       "web",
+				Fields:     map[string]string{"timestamp": "ts", "src": "ip"},
+				Dimensions: []string{"src", "sensor", "source"},
+			},
+			want: GenericConfig{
+				Name:            "web",
+				Title:           "web",
+				Fields:          map[string]string{"timestamp": "ts", "src": "ip"},
+				TimestampLayout: "Jan 2 15:04:05",
+				Dimensions:      []string{"src", "sensor", "source"},
+			},
+		},
+		{
+			name: "explicit pairs",
+			config: GenericConfig{
+				Name:   "web",
+				Fields: map[string]string{"timestamp": "ts", "src": "ip", "host": "vhost"},
+				Pairs:  [][2]string{{"host", "src"}},
+			},
+			want: GenericConfig{
+				Name:            "web",
+				Title:           "web",
+				Fields:          map[string]string{"timestamp": "ts", "src": "ip", "host": "vhost"},
+				TimestampLayout: "Jan 2 15:04:05",
+				Dimensions:      []string{"src", "host"},
+				Pairs:           [][2]string{{"host", "src"}},
+			},
+		},
+		{
+			name:    "pair of a dimension not counted",
+			config:  GenericConfig{Name: "web", Fields: map[string]string{"timestamp": "ts", "src": "ip", "url": "path"}, Pairs: [][2]string{{"src", "url"}}},
+			wantErr: true,
+		},
+		{
+			name:    "pair of a dimension with itself",
+			config:  GenericConfig{Name: "web", Fields: map[string]string{"timestamp": "ts", "src": "ip"}, Pairs: [][2]string{{"src", "src"}}},
+			wantErr: true,
+		},
+		{
+			name:    "optional dimension not counted",
+			config:  GenericConfig{Name: "web", Fields: map[string]string{"timestamp": "ts", "src": "ip", "host": "vhost"}, Dimensions: []string{"src"}, Optional: []string{"host"}},
+			wantErr: true,
+		},
+		{
+			name:    "name with a colon",
+			config:  GenericConfig{Name: "web:auth", Fields: map[string]string{"timestamp": "ts", "src": "ip"}},
+			wantErr: true,
+		},
+		{
+			name:    "name with a path separator",
+			config:  GenericConfig{Name: "../web", Fields: map[string]string{"timestamp": "ts", "src": "ip"}},
+			wantErr: true,
+		},
+		{
+			name:    "missing timestamp",
+			config:  GenericConfig{Name: "web", Fields: map[string]string{"src": "ip"}},
+			wantErr: true,
+		},
+		{
+			name:    "no dimension",
+			config:  GenericConfig{Name: "web", Fields: map[string]string{"timestamp": "ts", "url": "path"}},
+			wantErr: true,
+		},
+		{
+			name:    "unmapped dimension",
+			config:  GenericConfig{Name: "web", Fields: map[string]string{"timestamp": "ts", "src": "ip"}, Dimensions: []string{"src", "username"}},
+			wantErr: true,
+		},
+		{
+			name:    "timestamp dimension",
+			config:  GenericConfig{Name: "web", Fields: map[string]string{"timestamp": "ts", "src": "ip"}, Dimensions: []string{"timestamp"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			err := c.check()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("check() = %+v, want %+v", c, tt.want)
+			}
+		})
+	}
+}
+
+// newTestGeneric returns the generic compiler of c, checked
+func newTestGeneric(t *testing.T, c GenericConfig) *GenericCompiler {
+	t.Helper()
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+	return newGenericCompiler(c)
+}
+
+func TestGenericParseJSON(t *testing.T) {
+	s := newTestGeneric(t, GenericConfig{
+		Name: "web",
+		Fields: map[string]string{
+			"timestamp": "ts",
+			"src":       "client_ip",
+			"username":  "user",
+			"host":      "vhost",
+		},
+		TimestampLayout: "2006-01-02 15:04:05",
+		Optional:        []string{"host"},
+	})
+
+	e, err := s.parse([]byte(`{"ts": "2020-03-01 10:00:00", "client_ip": "1.2.3.4", "user": 42, "vhost": null, "other": "x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Numbers are kept as written, null fields are left out
+	if want := map[string]string{"src": "1.2.3.4", "username": "42"}; !reflect.DeepEqual(e.fields, want) {
+		t.Errorf("fields = %v, want %v", e.fields, want)
+	}
+	if e.timestamp != "2020-03-01 10:00:00" || e.layout != "2006-01-02 15:04:05" {
+		t.Errorf("timestamp = %q in %q", e.timestamp, e.layout)
+	}
+
+	if _, err := s.parse([]byte(`Mar  1 10:00:00 host postfix/smtpd[1]: not JSON`)); err == nil {
+		t.Error("parse() of a raw line should fail")
+	}
+	// Events missing a field that is not optional are set aside
+	if _, err := s.parse([]byte(`{"ts": "2020-03-01 10:00:00", "client_ip": "1.2.3.4", "vhost": "www"}`)); err == nil {
+		t.Error("parse() of a line without username should fail")
+	}
+}
+
+func TestLoadGenericCompilersSample(t *testing.T) {
+	if err := LoadGenericCompilers("../conf.sample/compilers"); err != nil {
+		t.Fatal(err)
+	}
+	if !IsRegistered("postfix") {
+		t.Fatal("the sample postfix compiler is not registered")
+	}
+	// A missing directory is not an error
+	if err := LoadGenericCompilers("testdata/none"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenericParseRaw(t *testing.T) {
+	s := newTestGeneric(t, GenericConfig{
+		Name: "cron",
+		Fields: map[string]string{
+			"timestamp": "syslog_timestamp",
+			"host":      "syslog_hostname",
+			"username":  "syslog_pid",
+		},
+		Program: "CRON",
+	})
+	s.SetOptions(Options{Raw: true})
+
+	e, err := s.parse([]byte("Mar  1 10:00:00 web1 CRON[4242]: (root) CMD (run-parts /etc/cron.hourly)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"host": "web1", "username": "4242"}; !reflect.DeepEqual(e.fields, want) {
+		t.Errorf("fields = %v, want %v", e.fields, want)
+	}
+	if e.timestamp != "Mar  1 10:00:00" {
+		t.Errorf("timestamp = %q, want Mar  1 10:00:00", e.timestamp)
+	}
+
+	// Lines of other programs are skipped
+	if e, err := s.parse([]byte("Mar  1 10:00:00 web1 sshd[1]: Invalid user a from 1.2.3.4")); e != nil || err != nil {
+		t.Errorf("parse() of another program = %v, %v, want nil, nil", e, err)
+	}
+	if _, err := s.parse([]byte("not syslog")); err == nil {
+		t.Error("parse() of a line that is not syslog should fail")
+	}
+}
+
+// sampleGrok compiles the sample grok expressions of compiler name
+func sampleGrok(t *testing.T, name string) grok.Patterns {
+	t.Helper()
+	g := grok.New()
+	if err := g.AddPatternsFromDir("../conf.sample/grok/patterns"); err != nil {
+		t.Fatal(err)
+	}
+	ps, err := g.CompileFile("../conf.sample/grok/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+func TestGenericParseGrok(t *testing.T) {
+	var c GenericConfig
+	b, err := ioutil.ReadFile("../conf.sample/compilers/postfix.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestGeneric(t, c)
+	s.SetOptions(Options{Grok: sampleGrok(t, "postfix")})
+
+	e, err := s.parse([]byte("Mar  1 10:00:00 mx1 postfix/smtpd[4242]: warning: unknown[1.2.3.4]: SASL LOGIN authentication failed: UGFzc3dvcmQ6, sasl_username=alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"src": "1.2.3.4", "username": "alice", "host": "mx1"}; !reflect.DeepEqual(e.fields, want) {
+		t.Errorf("fields = %v, want %v", e.fields, want)
+	}
+
+	// The username is optional in postfix.json
+	e, err = s.parse([]byte("Mar  1 10:00:00 mx1 postfix/smtpd[4242]: warning: unknown[1.2.3.4]: SASL PLAIN authentication failed: authentication failure"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"src": "1.2.3.4", "host": "mx1"}; !reflect.DeepEqual(e.fields, want) {
+		t.Errorf("fields = %v, want %v", e.fields, want)
+	}
+
+	// Lines matching no expression are skipped
+	if e, err := s.parse([]byte("Mar  1 10:00:00 mx1 postfix/smtpd[4242]: connect from unknown[1.2.3.4]")); e != nil || err != nil {
+		t.Errorf("parse() of an unmatched line = %v, %v, want nil, nil", e, err)
+	}
+}
+
+func TestGenericCheckOptions(t *testing.T) {
+	var c GenericConfig
+	b, err := ioutil.ReadFile("../conf.sample/compilers/postfix.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		t.Fatal(err)
+	}
+	postfix := newTestGeneric(t, c)
+	cron := newTestGeneric(t, GenericConfig{
+		Name:       "cron",
+		Fields:     map[string]string{"timestamp": "syslog_timestamp", "host": "syslog_hostname"},
+		Dimensions: []string{"host", "sensor"},
+	})
+
+	tests := []struct {
+		name    string
+		s       *GenericCompiler
+		opts    Options
+		wantErr bool
+	}{
+		{"groked JSON", postfix, Options{}, false},
+		{"raw lines lacking the fields", postfix, Options{Raw: true}, true},
+		{"raw lines groked", postfix, Options{Raw: true, Grok: sampleGrok(t, "postfix")}, false},
+		{"raw lines providing the fields", cron, Options{Raw: true}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.s.CheckOptions(tt.opts); (err != nil) != tt.wantErr {
+			t.Errorf("%v: CheckOptions() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package logcompiler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+// Rows of the heatmaps, Monday first
+var weekdays = []time.Weekday{
+	time.Monday, time.Tuesday, time.Wednesday, time.Thursday,
+	time.Friday, time.Saturday, time.Sunday,
+}
+
+// heatGrid counts events by hour of day (columns)
+// and weekday (rows), it implements plotter.GridXYZ
+type heatGrid [24][7]float64
+
+func (g *heatGrid) Dims() (c, r int)   { return 24, 7 }
+func (g *heatGrid) Z(c, r int) float64 { return g[c][r] }
+func (g *heatGrid) X(c int) float64    { return float64(c) }
+func (g *heatGrid) Y(r int) float64    { return float64(r) }
+
+// compileHourly counts an event in its hourly bucket, buckets
+// expire once they leave the hourly retention window
+func (s *CompilerStruct) compileHourly(b *Batch, t time.Time, fields map[string]string) {
+	if s.opts.Retention.Hourly <= 0 {
+		return
+	}
+	hour := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	expire := hour.Add(time.Hour + s.opts.Retention.Hourly)
+	if expire.Before(time.Now()) {
+		return
+	}
+
+	hstr := hour.Format("2006010215")
+	for _, d := range s.dimensions {
+		if d.Optional && fields[d.Key] == "" {
+			continue
+		}
+		b.Incr(fmt.Sprintf("%v:stats%v", hstr, d.Key), fields[d.Key], expire)
+	}
+}
+
+// compileHeatmap counts an event by weekday and hour
+// of day in the heatmap of a month or a year
+func (s *CompilerStruct) compileHeatmap(b *Batch, datestr string, t time.Time) {
+	field := fmt.Sprintf("%d:%d", t.Weekday(), t.Hour())
+	b.Incr(datestr+":heatmap", field, time.Time{})
+	b.Mark("heatmap", datestr)
+}
+
+// plotHeatmap draws the weekday by hour of day heatmap of a month or a year
+func (s *CompilerStruct) plotHeatmap(datestr string) error {
+	counts, err := s.store.Members(datestr + ":heatmap")
+	if err != nil {
+		return err
+	}
+
+	var g heatGrid
+	max := 1.0
+	for _, c := range counts {
+		kk := strings.SplitN(c.Name, ":", 2)
+		if len(kk) != 2 {
+			continue
+		}
+		wd, err1 := strconv.Atoi(kk[0])
+		h, err2 := strconv.Atoi(kk[1])
+		if err1 != nil || err2 != nil || wd < 0 || wd > 6 || h < 0 || h > 23 {
+			continue
+		}
+		// Monday first
+		row := (wd + 6) % 7
+		g[h][row] = c.Score
+		if c.Score > max {
+			max = c.Score
+		}
+	}
+
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	p.Title.Text = "Weekday and hour of day"
+	p.X.Label.Text = "Hour"
+
+	hm := plotter.NewHeatMap(&g, palette.Heat(12, 1))
+	hm.Min, hm.Max = 0, max
+	p.Add(hm)
+
+	hours := make([]string, 24)
+	for i := range hours {
+		hours[i] = strconv.Itoa(i)
+	}
+	days := make([]string, len(weekdays))
+	for i, d := range weekdays {
+		days[i] = d.String()[:3]
+	}
+	p.NominalX(hours...)
+	p.NominalY(days...)
+
+	if err := os.MkdirAll(filepath.Join("data", s.name, datestr), 0700); err != nil {
+		return err
+	}
+	return p.Save(20*vg.Centimeter, 8*vg.Centimeter, filepath.Join("data", s.name, datestr, fmt.Sprintf("%v:heatmap.svg", datestr)))
+}
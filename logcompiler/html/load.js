@@ -0,0 +1,134 @@
+function imgLoad(url) {
+    'use strict';
+    // Create new promise with the Promise() constructor;
+    // This has as its argument a function with two parameters, resolve and reject
+    return new Promise(function (resolve, reject) {
+        // Standard XHR to load an image
+        var request = new XMLHttpRequest();
+        request.open('GET', url);
+        request.responseType = 'blob';
+        
+        // When the request loads, check whether it was successful
+        request.onload = function () {
+            if (request.status === 200) {
+                // If successful, resolve the promise by passing back the request response
+                resolve(request.response);
+            } else {
+                // If it fails, reject the promise with a error message
+                reject(new Error('Image didn\'t load successfully; error code:' + request.statusText));
+            }
+        };
+      
+        request.onerror = function () {
+            // Also deal with the case when the entire request fails to begin with
+            // This is probably a network error, so reject the promise with an appropriate message
+            reject(new Error('There was a network error.'));
+        };
+      
+        // Send the request
+        request.send();
+    });
+}
+
+function loadImage(date, type) {
+    'use strict';
+    console.log(date);
+    console.log(type);
+    // Images are stored next to the page
+    showImage(date+'/'+date+':'+type+'.svg');
+    showDistinct(date+'/'+date+':distinct.csv');
+}
+
+function loadRange(from, to, type) {
+    'use strict';
+    console.log(from+'-'+to);
+    console.log(type);
+    // Ranges are computed by the analyzer http server
+    showImage('/range/'+compilerName+'?from='+from+'&to='+to+'&type='+type);
+    document.querySelector('#distinctholder').textContent = '';
+    document.querySelector('#drillholder').textContent = '';
+}
+
+function showDrill(date, type) {
+    'use strict';
+    // Top members of the day, clicking one shows the
+    // members of the other dimensions seen with it
+    var holder = document.querySelector('#drillholder'),
+    request = new XMLHttpRequest();
+    holder.textContent = '';
+    request.open('GET', date+'/'+date+':drill'+type.replace('stats', '')+'.json');
+    request.responseType = 'json';
+    request.onload = function () {
+        if (request.status !== 200 || !request.response) {
+            return;
+        }
+        var detail = document.createElement('p'),
+        list = document.createElement('ul');
+        request.response.forEach(function (d) {
+            var item = document.createElement('li'),
+            link = document.createElement('a');
+            link.href = '#';
+            link.textContent = d.name+' ('+d.score+')';
+            link.onclick = function () {
+                detail.textContent = d.name+' - '+Object.keys(d.with).map(function (k) {
+                    return (dimensionLabels[k] || k)+': '+d.with[k].map(function (m) {
+                        return m.name+' ('+m.score+')';
+                    }).join(', ');
+                }).join('; ');
+                return false;
+            };
+            item.appendChild(link);
+            list.appendChild(item);
+        });
+        holder.appendChild(detail);
+        holder.appendChild(list);
+    };
+    request.send();
+}
+
+function showDistinct(url) {
+    'use strict';
+    // Distinct counts of the period, a "key, count" csv line per dimension
+    var holder = document.querySelector('#distinctholder'),
+    request = new XMLHttpRequest();
+    request.open('GET', url);
+    request.onload = function () {
+        if (request.status !== 200) {
+            holder.textContent = '';
+            return;
+        }
+        var counts = [];
+        request.responseText.split('\n').forEach(function (line) {
+            var kv = line.split(', ');
+            if (kv.length === 2) {
+                counts.push((dimensionLabels[kv[0]] || kv[0])+': '+kv[1]);
+            }
+        });
+        holder.textContent = 'Distinct '+counts.join(', ');
+    };
+    request.onerror = function () {
+        holder.textContent = '';
+    };
+    request.send();
+}
+
+function showImage(url) {
+    'use strict';
+    // Get a reference to the body element, and create a new image object
+    var holder = document.querySelector('#imageholder'),
+    myImage = new Image();
+    myImage.crossOrigin = ""; // or "anonymous"
+    
+    // Call the function with the URL we want to load, but then chain the
+    // promise then() method on to the end of it. This contains two callbacks
+    imgLoad(url).then(function (response) {
+        // The first runs when the promise resolves, with the request.reponse specified within the resolve() method.
+        var imageURL = window.URL.createObjectURL(response);
+        myImage.src = imageURL;
+        holder.innerHTML = "";
+        holder.appendChild(myImage);
+        // The second runs when the promise is rejected, and logs the Error specified with the reject() method.
+    }, function (Error) {
+        console.log(Error);
+    });
+}
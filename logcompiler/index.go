@@ -0,0 +1,56 @@
+package logcompiler
+
+// Indexes of the days, months and years holding statistics,
+// sorted sets whose members all score 0, hence sorted by name
+const (
+	dayIndex   = "periods:days"
+	monthIndex = "periods:months"
+	yearIndex  = "periods:years"
+)
+
+// indexes gives the length of the periods of each index
+var indexes = map[string]int{
+	dayIndex:   8,
+	monthIndex: 6,
+	yearIndex:  4,
+}
+
+// periods returns the periods of an index, oldest first. Storages
+// filled before indexes existed are indexed on first use
+func (s *CompilerStruct) periods(index string) ([]string, error) {
+	members, err := s.store.Members(index)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		if err := s.reindex(); err != nil {
+			return nil, err
+		}
+		if members, err = s.store.Members(index); err != nil {
+			return nil, err
+		}
+	}
+	periods := make([]string, 0, len(members))
+	for _, m := range members {
+		periods = append(periods, m.Name)
+	}
+	return periods, nil
+}
+
+// reindex indexes the periods of the statistics found in the storage
+func (s *CompilerStruct) reindex() error {
+	keys, err := s.store.Keys("*")
+	if err != nil {
+		return err
+	}
+	b := NewBatch()
+	for _, k := range keys {
+		p := periodOf(k)
+		for index, length := range indexes {
+			if len(p) == length {
+				b.Index(index, p)
+			}
+		}
+	}
+	return s.store.Commit(b)
+}
@@ -0,0 +1,50 @@
+package logcompiler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPeriods(t *testing.T) {
+	s, bs, done := newTestCompiler(t)
+	defer done()
+
+	expect := func(index string, want ...string) {
+		t.Helper()
+		got, err := s.periods(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Errorf("periods(%v) = %v, want %v", index, got, want)
+		}
+	}
+
+	// Storages filled before the indexes are indexed on first use
+	commit(t, bs, func(b *Batch) {
+		b.Incr("20191231:statssrc", "1.2.3.4", time.Time{})
+		b.Incr("201912:statssrc", "1.2.3.4", time.Time{})
+		b.Set("oldest", "20191231")
+	})
+	expect(dayIndex, "20191231")
+	expect(yearIndex)
+
+	now := time.Now()
+	old := now.AddDate(0, 0, -40)
+	count(t, s,
+		rawEvent{Time: now, Fields: map[string]string{"src": "1.2.3.4", "username": "root"}},
+		rawEvent{Time: old, Fields: map[string]string{"src": "1.2.3.4", "username": "root"}},
+	)
+	expect(dayIndex, "20191231", old.Format("20060102"), now.Format("20060102"))
+	if months, _ := s.periods(monthIndex); months[0] != "201912" || months[len(months)-1] != now.Format("200601") {
+		t.Errorf("periods(months) = %v", months)
+	}
+
+	// Days whose statistics left their window leave the index
+	s.SetOptions(Options{Retention: Retention{Daily: 30 * 24 * time.Hour}})
+	if _, err := s.Janitor(); err != nil {
+		t.Fatal(err)
+	}
+	expect(dayIndex, now.Format("20060102"))
+}
@@ -0,0 +1,220 @@
+package logcompiler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Reclaimed reports what a janitor run deleted
+type Reclaimed struct {
+	// Days of raw events, and the events they held
+	RawDays   int
+	RawEvents int
+	// Raw events archived before deletion
+	Archived int
+	// Statistics sorted sets, and distinct counts for days
+	DailyStats  int
+	HourlyStats int
+	// Daily folders generated on disk, and their size
+	Folders int
+	Bytes   int64
+}
+
+func (rc Reclaimed) String() string {
+	return fmt.Sprintf("%v raw days (%v events, %v archived), %v daily and %v hourly statistics, %v folders (%v bytes)",
+		rc.RawDays, rc.RawEvents, rc.Archived, rc.DailyStats, rc.HourlyStats, rc.Folders, rc.Bytes)
+}
+
+// Janitor deletes the data that left its retention window: raw
+// events, after archiving them if configured, daily and hourly
+// statistics and daily files on disk. Weekly, monthly and
+// yearly statistics are rollups and are kept
+func (s *CompilerStruct) Janitor() (Reclaimed, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rc Reclaimed
+	now := time.Now()
+
+	if s.opts.Retention.Raw > 0 {
+		if err := s.expireRaw(now.Add(-s.opts.Retention.Raw), &rc); err != nil {
+			return rc, err
+		}
+	}
+	if err := s.expireStats(now, &rc); err != nil {
+		return rc, err
+	}
+	if s.opts.Retention.Files > 0 {
+		if err := s.expireFiles(now.Add(-s.opts.Retention.Files).Format("20060102"), &rc); err != nil {
+			return rc, err
+		}
+	}
+	return rc, nil
+}
+
+// expireRaw deletes the raw events of the days before cutoff,
+// and the loglines stored by previous versions
+func (s *CompilerStruct) expireRaw(cutoff time.Time, rc *Reclaimed) error {
+	day := cutoff.Format("20060102")
+	days, err := s.store.Days()
+	if err != nil {
+		return err
+	}
+	for _, d := range days {
+		if len(d) != 8 || d >= day {
+			continue
+		}
+		if s.opts.Retention.Archive != "" {
+			n, err := s.archiveDay(d)
+			if err != nil {
+				return err
+			}
+			rc.Archived += n
+		}
+		n, err := s.store.DeleteDay(d)
+		if err != nil {
+			return err
+		}
+		rc.RawDays++
+		rc.RawEvents += n
+	}
+
+	if l, ok := s.store.(legacyEvents); ok {
+		n, err := l.DeleteLegacy(cutoff)
+		if err != nil {
+			return err
+		}
+		rc.RawEvents += n
+	}
+	return nil
+}
+
+// archiveDay writes the raw events of day to <archive>/<compiler>/
+// raw-<day>.jsonl.gz, one JSON document per line, and returns their number
+func (s *CompilerStruct) archiveDay(day string) (int, error) {
+	dir := filepath.Join(s.opts.Retention.Archive, s.name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(dir, ".raw-"+day)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	w := bufio.NewWriter(zw)
+	n := 0
+	err = s.store.Replay(day, func(item []byte) error {
+		n++
+		w.Write(item)
+		return w.WriteByte('\n')
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(f.Name(), filepath.Join(dir, fmt.Sprintf("raw-%v.jsonl.gz", day)))
+}
+
+// expireStats deletes the daily and hourly statistics that left
+// their window, hourly buckets normally expire by themselves but
+// the window may have been shortened since
+func (s *CompilerStruct) expireStats(now time.Time, rc *Reclaimed) error {
+	if s.opts.Retention.Daily > 0 {
+		day := now.Add(-s.opts.Retention.Daily).Format("20060102")
+		keys, err := s.store.Keys("[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]:*")
+		if err != nil {
+			return err
+		}
+		var expired, days []string
+		for _, k := range keys {
+			if k[:8] < day {
+				expired = append(expired, k)
+				days = append(days, k[:8])
+			}
+		}
+		if err := s.store.Delete(expired...); err != nil {
+			return err
+		}
+		if err := s.store.Remove(dayIndex, days...); err != nil {
+			return err
+		}
+		rc.DailyStats += len(expired)
+
+		// The daily pages start at the oldest day kept
+		oldest, err := s.store.Get("oldest")
+		if err != nil {
+			return err
+		}
+		if oldest != "" && oldest < day {
+			if err := s.store.Set("oldest", day); err != nil {
+				return err
+			}
+		}
+	}
+
+	hour := now.Add(-s.opts.Retention.Hourly).Format("2006010215")
+	keys, err := s.store.Keys("[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]:stats*")
+	if err != nil {
+		return err
+	}
+	var expired []string
+	for _, k := range keys {
+		if k[:10] < hour {
+			expired = append(expired, k)
+		}
+	}
+	if err := s.store.Delete(expired...); err != nil {
+		return err
+	}
+	rc.HourlyStats += len(expired)
+	return nil
+}
+
+// expireFiles deletes the daily folders generated on disk before day
+func (s *CompilerStruct) expireFiles(day string, rc *Reclaimed) error {
+	dirs, err := ioutil.ReadDir(filepath.Join("data", s.name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 8 || d.Name() >= day {
+			continue
+		}
+		if _, err := strconv.Atoi(d.Name()); err != nil {
+			continue
+		}
+		path := filepath.Join("data", s.name, d.Name())
+		err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				rc.Bytes += fi.Size()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		rc.Folders++
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package logcompiler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestJanitor(t *testing.T) {
+	bs, done := newTestBolt(t, "sshd")
+	defer done()
+	archive, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archive)
+
+	now := time.Now()
+	today := now.Format("20060102")
+	hour := now.Format("2006010215")
+	old := now.AddDate(0, 0, -40)
+	oldDay := old.Format("20060102")
+	oldHour := old.Format("2006010215")
+	commit(t, bs, func(b *Batch) {
+		for _, e := range []string{`{"a":1}`, `{"a":2}`} {
+			b.Append(oldDay, []byte(e))
+		}
+		b.Append(today, []byte(`{"a":3}`))
+		for _, k := range []string{oldDay + ":statssrc", today + ":statssrc", oldHour + ":statssrc", hour + ":statssrc", old.Format("200601") + ":statssrc"} {
+			b.Incr(k, "1.2.3.4", time.Time{})
+		}
+	})
+	bs.Set("oldest", oldDay)
+
+	s := &CompilerStruct{name: "sshd", store: bs}
+	s.SetOptions(Options{Retention: Retention{
+		Hourly:  24 * time.Hour,
+		Raw:     30 * 24 * time.Hour,
+		Daily:   30 * 24 * time.Hour,
+		Archive: archive,
+	}})
+	rc, err := s.Janitor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Reclaimed{RawDays: 1, RawEvents: 2, Archived: 2, DailyStats: 1, HourlyStats: 1}); rc != want {
+		t.Errorf("Janitor() = %v, want %v", rc, want)
+	}
+
+	// Monthly rollups are kept
+	keys, _ := bs.Keys("*:stats*")
+	sort.Strings(keys)
+	want := []string{old.Format("200601") + ":statssrc", today + ":statssrc", hour + ":statssrc"}
+	sort.Strings(want)
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("statistics left = %v, want %v", keys, want)
+	}
+	if days, _ := bs.Days(); !reflect.DeepEqual(days, []string{today}) {
+		t.Errorf("raw days left = %v", days)
+	}
+	if oldest, _ := bs.Get("oldest"); oldest != now.Add(-30*24*time.Hour).Format("20060102") {
+		t.Errorf("oldest = %v", oldest)
+	}
+
+	// The raw events deleted are archived
+	f, err := os.Open(filepath.Join(archive, "sshd", "raw-"+oldDay+".jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archived []string
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		archived = append(archived, scanner.Text())
+	}
+	if want := []string{`{"a":1}`, `{"a":2}`}; !reflect.DeepEqual(archived, want) {
+		t.Errorf("archived = %v, want %v", archived, want)
+	}
+}
@@ -0,0 +1,84 @@
+package logcompiler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Layout tells where a compiler keeps its data in redis
+type Layout struct {
+	// Database of the loglines
+	RawDB int
+	// Database of the statistics and of the output bookkeeping
+	StatsDB int
+	// Database of the MISP objects
+	MISPDB int
+	// Prefix of every key of the compiler, {compiler}
+	// is replaced by the name of the compiler
+	Prefix string
+}
+
+// DefaultLayout is the historical layout: loglines in database 0,
+// statistics in database 1, MISP objects in database 3, no prefix
+var DefaultLayout = Layout{
+	RawDB:   0,
+	StatsDB: 1,
+	MISPDB:  3,
+}
+
+// LoadLayout reads a redis layout configuration file, one
+// "<setting> <value>" per line: raw, stats and misp take a database
+// number, prefix takes a key prefix. Missing settings, or a missing
+// file, get the defaults
+func LoadLayout(path string) (Layout, error) {
+	l := DefaultLayout
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return l, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return l, fmt.Errorf("%v:%v: should be <setting> <value>", path, n)
+		}
+		if fields[0] == "prefix" {
+			l.Prefix = fields[1]
+			continue
+		}
+		db, err := strconv.Atoi(fields[1])
+		if err != nil || db < 0 {
+			return l, fmt.Errorf("%v:%v: invalid database %v", path, n, fields[1])
+		}
+		switch fields[0] {
+		case "raw":
+			l.RawDB = db
+		case "stats":
+			l.StatsDB = db
+		case "misp":
+			l.MISPDB = db
+		default:
+			return l, fmt.Errorf("%v:%v: unknown setting %v", path, n, fields[0])
+		}
+	}
+	return l, scanner.Err()
+}
+
+// For returns the layout of the compiler name
+func (l Layout) For(name string) Layout {
+	l.Prefix = strings.Replace(l.Prefix, "{compiler}", name, -1)
+	return l
+}
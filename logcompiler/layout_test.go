@@ -0,0 +1,45 @@
+package logcompiler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadLayout(t *testing.T) {
+	// The sample keeps the keys the MISP export pops by default
+	l, err := LoadLayout("../conf.sample/redis_layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != DefaultLayout {
+		t.Errorf("sample layout = %+v, want %+v", l, DefaultLayout)
+	}
+
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "redis_layout")
+	if err := ioutil.WriteFile(path, []byte("raw 5\nprefix site1:{compiler}:\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err = LoadLayout(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Layout{RawDB: 5, StatsDB: 1, MISPDB: 3, Prefix: "site1:sshd:"}); l.For("sshd") != want {
+		t.Errorf("For(sshd) = %+v, want %+v", l.For("sshd"), want)
+	}
+
+	for _, conf := range []string{"raw -1", "stats one", "cache 2", "prefix"} {
+		if err := ioutil.WriteFile(path, []byte(conf+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadLayout(path); err == nil {
+			t.Errorf("LoadLayout() of %q should fail", conf)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package logcompiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of members of a day offered for drill-down
+	drillMembers = 100
+	// Number of members seen with each of them
+	drillPairs = 20
+)
+
+// drill is a member of a daily statistic, along with the
+// members of the other dimensions seen with it
+type drill struct {
+	Name  string              `json:"name"`
+	Score float64             `json:"score"`
+	With  map[string][]Member `json:"with"`
+}
+
+// compilePairs counts the pairs of an event in the sorted sets of its day
+func (s *CompilerStruct) compilePairs(b *Batch, day string, fields map[string]string) {
+	for _, p := range s.pairs {
+		if fields[p.From] == "" || fields[p.To] == "" {
+			continue
+		}
+		b.Incr(fmt.Sprintf("%v:pair%v-%v:%v", day, p.From, p.To, fields[p.From]), fields[p.To], time.Time{})
+	}
+}
+
+// Pairs returns, for each dimension paired with dimension, the n
+// members seen most with value on day, YYYYMMDD, highest first
+func (s *CompilerStruct) Pairs(day string, dimension string, value string, n int) (map[string][]Member, error) {
+	if _, err := time.Parse("20060102", day); err != nil {
+		return nil, fmt.Errorf("invalid day %q", day)
+	}
+	with := make(map[string][]Member)
+	for _, p := range s.pairs {
+		if p.From != dimension {
+			continue
+		}
+		top, err := s.store.Top(fmt.Sprintf("%v:pair%v-%v:%v", day, p.From, p.To, value), n)
+		if err != nil {
+			return nil, err
+		}
+		with[p.To] = top
+	}
+	if len(with) == 0 {
+		return nil, fmt.Errorf("dimension %q has no pairs", dimension)
+	}
+	return with, nil
+}
+
+// drillDown writes the top members of a daily statistic, with the
+// members seen with each of them, to <day>/<day>:drill<dimension>.json
+// for the drill-down views of the daily page
+func (s *CompilerStruct) drillDown(v string) error {
+	stype := strings.Split(v, ":")
+	dimension := strings.TrimPrefix(stype[1], "stats")
+	paired := false
+	for _, p := range s.pairs {
+		paired = paired || p.From == dimension
+	}
+	if !paired {
+		return nil
+	}
+
+	top, err := s.store.Top(v, drillMembers)
+	if err != nil {
+		return err
+	}
+	drills := make([]drill, 0, len(top))
+	for _, m := range top {
+		with, err := s.Pairs(stype[0], dimension, m.Name, drillPairs)
+		if err != nil {
+			return err
+		}
+		drills = append(drills, drill{Name: m.Name, Score: m.Score, With: with})
+	}
+	b, err := json.Marshal(drills)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join("data", s.name, stype[0])
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%v:drill%v.json", stype[0], dimension)), b, 0644)
+}
@@ -0,0 +1,46 @@
+package logcompiler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPairs(t *testing.T) {
+	bs, done := newTestBolt(t, "sshd")
+	defer done()
+	s := &CompilerStruct{name: "sshd", store: bs, pairs: []Pair{{From: "src", To: "username"}, {From: "src", To: "host"}}}
+
+	commit(t, bs, func(b *Batch) {
+		for _, f := range []map[string]string{
+			{"src": "1.2.3.4", "username": "root", "host": "bastion"},
+			{"src": "1.2.3.4", "username": "root", "host": "mx1"},
+			{"src": "1.2.3.4", "username": "admin"},
+			{"src": "5.6.7.8", "username": "test", "host": "bastion"},
+			// Events missing a side of a pair do not count it
+			{"username": "root", "host": "bastion"},
+		} {
+			s.compilePairs(b, "20200301", f)
+		}
+	})
+
+	with, err := s.Pairs("20200301", "src", "1.2.3.4", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Member{{"root", 2}, {"admin", 1}}; !reflect.DeepEqual(with["username"], want) {
+		t.Errorf("usernames paired = %v, want %v", with["username"], want)
+	}
+	if len(with["host"]) != 2 {
+		t.Errorf("hosts paired = %v, want bastion and mx1", with["host"])
+	}
+	if with, _ := s.Pairs("20200301", "src", "1.2.3.4", 1); len(with["username"]) != 1 {
+		t.Errorf("Pairs() limited to 1 = %v", with)
+	}
+
+	if _, err := s.Pairs("20200301", "username", "root", 10); err == nil {
+		t.Error("Pairs() of a dimension with no pairs should fail")
+	}
+	if _, err := s.Pairs("2020-03-01", "src", "1.2.3.4", 10); err == nil {
+		t.Error("Pairs() of an invalid day should fail")
+	}
+}
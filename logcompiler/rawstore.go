@@ -0,0 +1,66 @@
+package logcompiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// Number of stored events read at once when replaying a day
+	replayBatch = 1000
+	// Number of lines read in a same batch, they are
+	// acknowledged once the batch is committed
+	pullBatch = 200
+	// Longest time a line waits in a batch, inputs that
+	// go idle return io.EOF and commit it sooner
+	pullPeriod = time.Second
+)
+
+// rawEvent is an event as kept by the storage, every event is
+// appended to the events of its day so that statistics can be
+// recomputed exactly
+type rawEvent struct {
+	// Time keeps the offset of the event, hence its day and hour
+	Time   time.Time         `json:"time"`
+	Fields map[string]string `json:"fields"`
+	// Line is the logline the event was parsed from
+	Line string `json:"line,omitempty"`
+}
+
+// legacyEvents is implemented by storages holding the loglines of
+// previous versions of the analyzer, stored by second and host
+type legacyEvents interface {
+	// ReplayLegacy feeds the legacy loglines to f
+	ReplayLegacy(f func(time.Time, map[string]string) error) error
+	// DeleteLegacy deletes the legacy loglines older
+	// than before and returns how many there were
+	DeleteLegacy(before time.Time) (int, error)
+}
+
+// storeEvent appends an event to the events of its day in b
+func (s *CompilerStruct) storeEvent(b *Batch, e *event, line []byte) error {
+	j, err := json.Marshal(rawEvent{Time: e.time, Fields: e.fields, Line: string(line)})
+	if err != nil {
+		return err
+	}
+	b.Append(e.time.Format("20060102"), j)
+	return nil
+}
+
+// replayDay feeds the events stored for day to f,
+// in the order they were counted
+func (s *CompilerStruct) replayDay(day string, f func(time.Time, map[string]string) error) error {
+	n := 0
+	return s.store.Replay(day, func(item []byte) error {
+		n++
+		var re rawEvent
+		if err := json.Unmarshal(item, &re); err != nil {
+			return fmt.Errorf("raw events of %v, #%v: %v", day, n, err)
+		}
+		if re.Fields == nil {
+			re.Fields = make(map[string]string)
+		}
+		return f(re.Time, re.Fields)
+	})
+}
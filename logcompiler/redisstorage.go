@@ -0,0 +1,601 @@
+package logcompiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// RedisStorage implements Storage on a redis server, following a Layout
+type RedisStorage struct {
+	layout Layout
+	// One pool per database
+	raw   *redis.Pool
+	stats *redis.Pool
+	misp  *redis.Pool
+}
+
+// NewRedisStorage returns the storage on the redis server
+// at addr, host:port, laid out by l
+func NewRedisStorage(addr string, l Layout) (*RedisStorage, error) {
+	rs := &RedisStorage{
+		layout: l,
+		raw:    newDBPool(addr, l.RawDB),
+		stats:  newDBPool(addr, l.StatsDB),
+		misp:   newDBPool(addr, l.MISPDB),
+	}
+	r := rs.stats.Get()
+	defer r.Close()
+	if _, err := r.Do("PING"); err != nil {
+		rs.Close()
+		return nil, err
+	}
+	return rs, nil
+}
+
+func newDBPool(addr string, db int) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, redis.DialDatabase(db))
+		},
+	}
+}
+
+// key returns the redis key of k
+func (rs *RedisStorage) key(k string) string {
+	return rs.layout.Prefix + k
+}
+
+// spanScript moves the oldest and newest days,
+// KEYS[1] and KEYS[2], outwards to ARGV[1] and ARGV[2]
+var spanScript = redis.NewScript(2, `
+local oldest = redis.call('GET', KEYS[1])
+if not oldest or ARGV[1] < oldest then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+local newest = redis.call('GET', KEYS[2])
+if not newest or ARGV[2] > newest then
+	redis.call('SET', KEYS[2], ARGV[2])
+end
+return 0`)
+
+// Commit writes b in a single transaction, in a single round trip: the
+// databases being on the same server, the transaction selects the
+// loglines database for the raw events, then the statistics database
+// back for the rest. Redis does not roll back the commands of a
+// transaction that ran when one of them fails, e.g. on a key holding
+// the wrong type, nor makes it durable before persisting it
+func (rs *RedisStorage) Commit(b *Batch) error {
+	r := rs.stats.Get()
+	defer r.Close()
+	r.Send("MULTI")
+	if len(b.events) > 0 {
+		shared := rs.layout.RawDB == rs.layout.StatsDB
+		if !shared {
+			r.Send("SELECT", rs.layout.RawDB)
+		}
+		for day, events := range b.events {
+			args := redis.Args{}.Add(rs.key("raw:" + day))
+			for _, e := range events {
+				args = args.Add(e)
+			}
+			r.Send("RPUSH", args...)
+		}
+		if !shared {
+			r.Send("SELECT", rs.layout.StatsDB)
+		}
+	}
+	for key, members := range b.incrs {
+		for member, n := range members {
+			r.Send("ZINCRBY", rs.key(key), n, member)
+		}
+		if expire, ok := b.expires[key]; ok {
+			r.Send("EXPIREAT", rs.key(key), expire.Unix())
+		}
+	}
+	for key, members := range b.distinct {
+		args := redis.Args{}.Add(rs.key(key))
+		for member := range members {
+			args = args.Add(member)
+		}
+		r.Send("PFADD", args...)
+	}
+	for key, members := range b.index {
+		args := redis.Args{}.Add(rs.key(key))
+		for member := range members {
+			args = args.Add(0, member)
+		}
+		r.Send("ZADD", args...)
+	}
+	for granularity, members := range b.marks {
+		args := redis.Args{}.Add(rs.key("toupdate:" + granularity))
+		for member := range members {
+			args = args.Add(member)
+		}
+		r.Send("SADD", args...)
+	}
+	for key, value := range b.values {
+		r.Send("SET", rs.key(key), value)
+	}
+	if b.oldest != "" {
+		spanScript.Send(r, rs.key("oldest"), rs.key("newest"), b.oldest, b.newest)
+	}
+	_, err := exec(r)
+	return err
+}
+
+// Members returns the members of the statistics key, by ascending score
+func (rs *RedisStorage) Members(key string) ([]Member, error) {
+	r := rs.stats.Get()
+	defer r.Close()
+	return toMembers(redis.Strings(r.Do("ZRANGEBYSCORE", rs.key(key), "-inf", "+inf", "WITHSCORES")))
+}
+
+// Top returns the n members of the statistics key with the highest scores
+func (rs *RedisStorage) Top(key string, n int) ([]Member, error) {
+	r := rs.stats.Get()
+	defer r.Close()
+	return toMembers(redis.Strings(r.Do("ZREVRANGE", rs.key(key), 0, n-1, "WITHSCORES")))
+}
+
+// toMembers reads a WITHSCORES reply
+func toMembers(zrank []string, err error) ([]Member, error) {
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Member, 0, len(zrank)/2)
+	for i := 0; i+1 < len(zrank); i += 2 {
+		score, err := strconv.ParseFloat(zrank[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, Member{Name: zrank[i], Score: score})
+	}
+	return members, nil
+}
+
+// Union sums the statistics keys into dest, which expires after ttl
+func (rs *RedisStorage) Union(dest string, keys []string, ttl time.Duration) error {
+	r := rs.stats.Get()
+	defer r.Close()
+	args := redis.Args{}.Add(rs.key(dest), len(keys))
+	for _, k := range keys {
+		args = args.Add(rs.key(k))
+	}
+	if _, err := r.Do("ZUNIONSTORE", args...); err != nil {
+		return err
+	}
+	if ttl == 0 {
+		return nil
+	}
+	_, err := r.Do("EXPIRE", rs.key(dest), int(ttl/time.Second))
+	return err
+}
+
+// Merge sets the HyperLogLog dest to the union of the HyperLogLogs
+// keys, PFMERGE would otherwise count what dest held
+func (rs *RedisStorage) Merge(dest string, keys []string) error {
+	r := rs.stats.Get()
+	defer r.Close()
+	args := redis.Args{}.Add(rs.key(dest))
+	for _, k := range keys {
+		args = args.Add(rs.key(k))
+	}
+	r.Send("MULTI")
+	r.Send("DEL", rs.key(dest))
+	r.Send("PFMERGE", args...)
+	_, err := exec(r)
+	return err
+}
+
+// Distinct returns the distinct count of the HyperLogLogs keys,
+// with the standard error of 0.81% of redis
+func (rs *RedisStorage) Distinct(keys ...string) (int64, error) {
+	r := rs.stats.Get()
+	defer r.Close()
+	args := redis.Args{}
+	for _, k := range keys {
+		args = args.Add(rs.key(k))
+	}
+	return redis.Int64(r.Do("PFCOUNT", args...))
+}
+
+// Exists tells whether the statistics key exists
+func (rs *RedisStorage) Exists(key string) (bool, error) {
+	r := rs.stats.Get()
+	defer r.Close()
+	return redis.Bool(r.Do("EXISTS", rs.key(key)))
+}
+
+// Get returns the value key, or "" if it does not exist
+func (rs *RedisStorage) Get(key string) (string, error) {
+	r := rs.stats.Get()
+	defer r.Close()
+	v, err := redis.String(r.Do("GET", rs.key(key)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return v, err
+}
+
+// Set sets the value key
+func (rs *RedisStorage) Set(key string, value string) error {
+	r := rs.stats.Get()
+	defer r.Close()
+	_, err := r.Do("SET", rs.key(key), value)
+	return err
+}
+
+// Keys returns the statistics and values matching the glob pattern
+func (rs *RedisStorage) Keys(pattern string) ([]string, error) {
+	r := rs.stats.Get()
+	defer r.Close()
+	var keys []string
+	err := scanKeys(r, rs.key(pattern), func(batch []string) error {
+		for _, k := range batch {
+			keys = append(keys, strings.TrimPrefix(k, rs.key("")))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Remove removes members from the statistics key
+func (rs *RedisStorage) Remove(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	r := rs.stats.Get()
+	defer r.Close()
+	_, err := r.Do("ZREM", redis.Args{}.Add(rs.key(key)).AddFlat(members)...)
+	return err
+}
+
+// Delete deletes statistics and values
+func (rs *RedisStorage) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	r := rs.stats.Get()
+	defer r.Close()
+	args := redis.Args{}
+	for _, k := range keys {
+		args = args.Add(rs.key(k))
+	}
+	_, err := r.Do("DEL", args...)
+	return err
+}
+
+// Take moves the markers of granularity aside and returns them.
+// Markers set meanwhile go to a fresh set
+func (rs *RedisStorage) Take(granularity string) ([]string, error) {
+	r := rs.stats.Get()
+	defer r.Close()
+	key := rs.key("toupdate:" + granularity)
+	taken := key + ":compiling"
+	r.Send("MULTI")
+	r.Send("SUNIONSTORE", taken, taken, key)
+	r.Send("DEL", key)
+	if _, err := exec(r); err != nil {
+		return nil, err
+	}
+	return redis.Strings(r.Do("SMEMBERS", taken))
+}
+
+// Clear drops the markers taken
+func (rs *RedisStorage) Clear(granularity string) error {
+	r := rs.stats.Get()
+	defer r.Close()
+	_, err := r.Do("DEL", rs.key("toupdate:"+granularity+":compiling"))
+	return err
+}
+
+// Marked returns the markers of granularity, taken or not
+func (rs *RedisStorage) Marked(granularity string) ([]string, error) {
+	r := rs.stats.Get()
+	defer r.Close()
+	key := rs.key("toupdate:" + granularity)
+	return redis.Strings(r.Do("SUNION", key, key+":compiling"))
+}
+
+// Replay feeds the raw events of day to f
+func (rs *RedisStorage) Replay(day string, f func([]byte) error) error {
+	r := rs.raw.Get()
+	defer r.Close()
+	for start := 0; ; start += replayBatch {
+		items, err := redis.ByteSlices(r.Do("LRANGE", rs.key("raw:"+day), start, start+replayBatch-1))
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := f(item); err != nil {
+				return err
+			}
+		}
+		if len(items) < replayBatch {
+			return nil
+		}
+	}
+}
+
+// Days returns the days holding raw events
+func (rs *RedisStorage) Days() ([]string, error) {
+	r := rs.raw.Get()
+	defer r.Close()
+	var days []string
+	err := scanKeys(r, rs.key("raw:*"), func(keys []string) error {
+		for _, k := range keys {
+			days = append(days, strings.TrimPrefix(k, rs.key("raw:")))
+		}
+		return nil
+	})
+	return days, err
+}
+
+// DeleteDay deletes the raw events of day
+func (rs *RedisStorage) DeleteDay(day string) (int, error) {
+	r := rs.raw.Get()
+	defer r.Close()
+	r.Send("MULTI")
+	r.Send("LLEN", rs.key("raw:"+day))
+	r.Send("DEL", rs.key("raw:"+day))
+	replies, err := exec(r)
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(replies[0], nil)
+}
+
+// ReplayLegacy feeds the <unixtime>:<host> hashes, written by
+// previous versions of the analyzer, to f
+func (rs *RedisStorage) ReplayLegacy(f func(time.Time, map[string]string) error) error {
+	r := rs.raw.Get()
+	defer r.Close()
+	return rs.scanLegacy(r, func(key string, t time.Time, host string) error {
+		fields, err := redis.StringMap(r.Do("HGETALL", key))
+		if err != nil {
+			return err
+		}
+		fields["host"] = host
+		return f(t, fields)
+	})
+}
+
+// DeleteLegacy deletes the legacy hashes older than before
+func (rs *RedisStorage) DeleteLegacy(before time.Time) (int, error) {
+	r := rs.raw.Get()
+	defer r.Close()
+	n := 0
+	err := rs.scanLegacy(r, func(key string, t time.Time, host string) error {
+		if !t.Before(before) {
+			return nil
+		}
+		if _, err := r.Do("DEL", key); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// scanLegacy feeds the legacy hashes to f
+func (rs *RedisStorage) scanLegacy(r redis.Conn, f func(string, time.Time, string) error) error {
+	var keys []string
+	err := scanKeys(r, rs.key("[0-9]*:*"), func(batch []string) error {
+		keys = append(keys, batch...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		dateHost := strings.SplitN(strings.TrimPrefix(k, rs.key("")), ":", 2)
+		dateInt, err := strconv.ParseInt(dateHost[0], 10, 64)
+		if err != nil || len(dateHost) != 2 {
+			continue
+		}
+		// Statistics may share the database
+		if t, err := redis.String(r.Do("TYPE", k)); err != nil {
+			return err
+		} else if t != "hash" {
+			continue
+		}
+		if err := f(k, time.Unix(dateInt, 0), dateHost[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Staging returns the storage of the staging:
+// namespace, in the databases of the storage
+func (rs *RedisStorage) Staging() (Storage, error) {
+	l := rs.layout
+	l.Prefix += "staging:"
+	return &RedisStorage{layout: l, raw: rs.raw, stats: rs.stats, misp: rs.misp}, nil
+}
+
+// Number of keys renamed or deleted per transaction by Swap
+const swapChunk = 1000
+
+// Swap renames the statistics and values of staging matching filter,
+// replacing the current ones, then deletes the current ones matching
+// filter that were not rebuilt, and the rest of staging. Keys are
+// swapped swapChunk at a time, for redis not to block on a huge
+// transaction: readers may see old and rebuilt statistics side by side
+// meanwhile. Staging must be in the statistics database
+func (rs *RedisStorage) Swap(staging Storage, filter func(string) bool) ([]string, error) {
+	st, ok := staging.(*RedisStorage)
+	if !ok || st.layout.StatsDB != rs.layout.StatsDB {
+		return nil, fmt.Errorf("staging is not in the statistics database")
+	}
+	r := rs.stats.Get()
+	defer r.Close()
+
+	var current, swapped, dropped []string
+	err := scanKeys(r, rs.key("*"), func(keys []string) error {
+		for _, k := range keys {
+			k = strings.TrimPrefix(k, rs.key(""))
+			if !strings.HasPrefix(k, "staging:") && filter(k) {
+				current = append(current, k)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanKeys(r, st.key("*"), func(keys []string) error {
+		for _, k := range keys {
+			if k := strings.TrimPrefix(k, st.key("")); filter(k) {
+				swapped = append(swapped, k)
+			} else {
+				dropped = append(dropped, st.key(k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// RENAME replaces the current key, the others are deleted
+	rebuilt := make(map[string]bool)
+	var renames, deletes []redis.Args
+	for _, k := range swapped {
+		rebuilt[k] = true
+		renames = append(renames, redis.Args{st.key(k), rs.key(k)})
+	}
+	for _, k := range current {
+		if !rebuilt[k] {
+			deletes = append(deletes, redis.Args{rs.key(k)})
+		}
+	}
+	if err := execChunks(r, "RENAME", renames); err != nil {
+		return nil, err
+	}
+	if err := execChunks(r, "DEL", deletes); err != nil {
+		return nil, err
+	}
+	for _, k := range dropped {
+		if _, err := r.Do("DEL", k); err != nil {
+			return nil, err
+		}
+	}
+	return swapped, nil
+}
+
+// Push appends value to the export list, in the MISP database
+func (rs *RedisStorage) Push(list string, value []byte) error {
+	r := rs.misp.Get()
+	defer r.Close()
+	_, err := r.Do("LPUSH", rs.key(list), value)
+	return err
+}
+
+// Flush deletes the statistics, values and markers, the whole
+// statistics database when keys are not prefixed
+func (rs *RedisStorage) Flush() error {
+	r := rs.stats.Get()
+	defer r.Close()
+	shared := rs.layout.RawDB == rs.layout.StatsDB
+	if rs.layout.Prefix == "" && !shared {
+		_, err := r.Do("FLUSHDB")
+		return err
+	}
+	return scanKeys(r, rs.key("*"), func(keys []string) error {
+		args := redis.Args{}
+		for _, k := range keys {
+			// Raw events may share the database
+			if shared && strings.HasPrefix(k, rs.key("raw:")) {
+				continue
+			}
+			// Legacy loglines as well
+			if shared {
+				if t, err := redis.String(r.Do("TYPE", k)); err != nil {
+					return err
+				} else if t == "hash" {
+					continue
+				}
+			}
+			args = args.Add(k)
+		}
+		if len(args) == 0 {
+			return nil
+		}
+		_, err := r.Do("DEL", args...)
+		return err
+	})
+}
+
+// Close closes the connections
+func (rs *RedisStorage) Close() error {
+	rs.raw.Close()
+	rs.stats.Close()
+	return rs.misp.Close()
+}
+
+// exec runs the transaction opened on r and returns its replies, or
+// the error of the first command that failed within it
+func exec(r redis.Conn) ([]interface{}, error) {
+	replies, err := redis.Values(r.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// execChunks runs command with each of args,
+// in transactions of swapChunk commands
+func execChunks(r redis.Conn, command string, args []redis.Args) error {
+	for len(args) > 0 {
+		n := len(args)
+		if n > swapChunk {
+			n = swapChunk
+		}
+		r.Send("MULTI")
+		for _, a := range args[:n] {
+			r.Send(command, a...)
+		}
+		if _, err := exec(r); err != nil {
+			return err
+		}
+		args = args[n:]
+	}
+	return nil
+}
+
+// scanKeys feeds the keys matching pattern in the
+// database of r to f, a batch at a time, without blocking redis
+func scanKeys(r redis.Conn, pattern string, f func([]string) error) error {
+	cursor := int64(0)
+	for {
+		reply, err := redis.Values(r.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := f(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package logcompiler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type (
+	// Factory returns a new Compiler, it is Set by the caller
+	Factory func() Compiler
+
+	// registration holds what we know about a registered compiler
+	registration struct {
+		description string
+		factory     Factory
+	}
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]registration)
+)
+
+// Register makes a compiler available under name.
+// Compilers register themselves in their init function,
+// it panics if name is empty, already taken or factory is nil
+func Register(name string, description string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" {
+		panic("logcompiler: Register with an empty name")
+	}
+	if factory == nil {
+		panic("logcompiler: Register factory is nil for " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("logcompiler: Register called twice for " + name)
+	}
+	registry[name] = registration{
+		description: description,
+		factory:     factory,
+	}
+}
+
+// IsRegistered tells whether a compiler is registered under name
+func IsRegistered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	_, ok := registry[name]
+	return ok
+}
+
+// New creates a new compiler from its registered name
+func New(name string) (Compiler, error) {
+	registryMu.RLock()
+	reg, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown compiler %q", name)
+	}
+	return reg.factory(), nil
+}
+
+// Names returns the sorted list of registered compilers
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for k := range registry {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Description returns the short description of a registered compiler
+func Description(name string) string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registry[name].description
+}
@@ -0,0 +1,91 @@
+package logcompiler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention holds how long data is kept
+type Retention struct {
+	// Hourly buckets, they are not kept when zero
+	Hourly time.Duration
+	// Raw events, daily statistics and daily files
+	// generated on disk, they are kept forever when zero
+	Raw   time.Duration
+	Daily time.Duration
+	Files time.Duration
+	// Archive is the directory where raw events are
+	// written before deletion, they are dropped when empty
+	Archive string
+}
+
+// DefaultRetention keeps hourly buckets for a week, and everything else
+var DefaultRetention = Retention{
+	Hourly: 7 * 24 * time.Hour,
+}
+
+// LoadRetention reads a retention configuration file, one
+// "<data class> <duration>" per line, durations accept a "d" suffix
+// for days, and "archive <directory>". Missing data classes, or
+// a missing file, get the defaults
+func LoadRetention(path string) (Retention, error) {
+	r := DefaultRetention
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return r, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			return r, fmt.Errorf("%v:%v: should be <data class> <duration>", path, n)
+		}
+		if fields[0] == "archive" {
+			r.Archive = fields[1]
+			continue
+		}
+		d, err := parseDuration(fields[1])
+		if err != nil {
+			return r, fmt.Errorf("%v:%v: %v", path, n, err)
+		}
+		switch fields[0] {
+		case "hourly":
+			r.Hourly = d
+		case "raw":
+			r.Raw = d
+		case "daily":
+			r.Daily = d
+		case "files":
+			r.Files = d
+		default:
+			return r, fmt.Errorf("%v:%v: unknown data class %v", path, n, fields[0])
+		}
+	}
+	return r, scanner.Err()
+}
+
+// parseDuration parses a duration, "30d" meaning 30 days
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		d, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %v", s)
+		}
+		return time.Duration(d) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
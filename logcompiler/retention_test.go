@@ -0,0 +1,51 @@
+package logcompiler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadRetention(t *testing.T) {
+	r, err := LoadRetention("../conf.sample/retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != DefaultRetention {
+		t.Errorf("sample retention = %+v, want the defaults", r)
+	}
+	if r, err := LoadRetention("testdata/none"); err != nil || r != DefaultRetention {
+		t.Errorf("missing file = %+v, %v, want the defaults", r, err)
+	}
+
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "retention")
+	write := func(conf string) {
+		if err := ioutil.WriteFile(path, []byte(conf), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# comment\n\nhourly 0\nraw 90d\ndaily 36h\narchive /var/lib/archive\n")
+	r, err = LoadRetention(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Retention{Raw: 90 * 24 * time.Hour, Daily: 36 * time.Hour, Archive: "/var/lib/archive"}
+	if r != want {
+		t.Errorf("LoadRetention() = %+v, want %+v", r, want)
+	}
+
+	for _, conf := range []string{"raw", "raw 90 days", "raw xd", "weekly 30d"} {
+		write(conf + "\n")
+		if _, err := LoadRetention(path); err == nil {
+			t.Errorf("LoadRetention() of %q should fail", conf)
+		}
+	}
+}
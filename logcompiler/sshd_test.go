@@ -0,0 +1,47 @@
+package logcompiler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSSHDParse(t *testing.T) {
+	s := &SSHDCompiler{}
+	want := map[string]string{"src": "1.2.3.4", "username": "admin", "host": "bastion"}
+
+	e, err := s.parse([]byte(`{"syslog_timestamp": "Mar  1 10:00:00", "syslog_hostname": "bastion", "sshd_client_ip": "1.2.3.4", "sshd_invalid_user": "admin"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.fields, want) {
+		t.Errorf("groked fields = %v, want %v", e.fields, want)
+	}
+
+	s.SetOptions(Options{Raw: true})
+	e, err = s.parse([]byte("Mar  1 10:00:00 bastion sshd[812]: Invalid user admin from 1.2.3.4 port 4242"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.fields, want) {
+		t.Errorf("raw fields = %v, want %v", e.fields, want)
+	}
+
+	// Other sshd messages and programs are skipped
+	for _, l := range []string{
+		"Mar  1 10:00:00 bastion sshd[812]: Accepted publickey for git from 1.2.3.4 port 4242 ssh2",
+		"Mar  1 10:00:00 bastion su[812]: Invalid user admin from 1.2.3.4",
+	} {
+		if e, err := s.parse([]byte(l)); e != nil || err != nil {
+			t.Errorf("parse(%q) = %v, %v, want nil, nil", l, e, err)
+		}
+	}
+
+	s.SetOptions(Options{Grok: sampleGrok(t, "sshd")})
+	e, err = s.parse([]byte("Mar  1 10:00:00 bastion sshd[812]: Failed password for admin from 1.2.3.4 port 4242 ssh2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.fields, want) {
+		t.Errorf("grok fields = %v, want %v", e.fields, want)
+	}
+}
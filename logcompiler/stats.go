@@ -0,0 +1,632 @@
+package logcompiler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/D4-project/analyzer-d4-log/inputreader"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+)
+
+// event is a log line reduced to what compilers count
+type event struct {
+	// When it happened, parsed by pull from the
+	// timestamp of the logline and its layout
+	time      time.Time
+	timestamp string
+	layout    string
+	// Values of the event, keyed by Dimension Key
+	fields map[string]string
+}
+
+// parseFunc turns a line of log into an event,
+// it returns a nil event for lines that should be skipped
+type parseFunc func([]byte) (*event, error)
+
+// commit writes b to the storage and empties it
+func (s *CompilerStruct) commit(b *Batch) error {
+	if err := s.store.Commit(b); err != nil {
+		return err
+	}
+	b.Reset()
+	return nil
+}
+
+// pull reads the input line by line, turns each line into an event
+// using parse, then stores and counts it
+func (s *CompilerStruct) pull(parse parseFunc) {
+	lr := inputreader.NewLineReader(s.reader)
+	// Readers checkpointing their progress are told
+	// once the lines of a batch have been committed
+	ack := func() error { return nil }
+	if a, ok := lr.(inputreader.Acknowledger); ok {
+		ack = a.Ack
+	}
+	bl, ok := lr.(inputreader.Blocking)
+	blocking := ok && bl.Blocking()
+
+	// Lines are counted a batch at a time
+	batch := NewBatch()
+	// Lines read since the last commit, skipped ones
+	// included, and when the first one was read
+	read := 0
+	var started time.Time
+	flush := func() error {
+		if read == 0 {
+			return nil
+		}
+		// Lines stay unacknowledged while the statistics are rebuilt
+		if err := s.waitFlush(); err != nil {
+			return err
+		}
+		batch.Set(committedKey, strconv.FormatInt(time.Now().UnixNano(), 10))
+		if err := s.commit(batch); err != nil {
+			return err
+		}
+		read = 0
+		return ack()
+	}
+
+	for {
+		l, err := lr.ReadLine()
+		if err == io.EOF {
+			s.nbLines += batch.Len()
+			if err := flush(); err != nil {
+				s.teardown(err)
+				return
+			}
+			// EOF, we wait for the reader to have
+			// new data available, unless it waited already
+			if !blocking {
+				time.Sleep(s.retryPeriod)
+			}
+			continue
+		} else if err != nil {
+			s.teardown(err)
+			return
+		}
+
+		if read == 0 {
+			started = time.Now()
+		}
+		read++
+		if err := s.process(batch, l, parse); err != nil {
+			s.teardown(err)
+			return
+		}
+		if read < pullBatch && time.Since(started) < pullPeriod {
+			continue
+		}
+		n := batch.Len()
+		if err := flush(); err != nil {
+			s.teardown(err)
+			return
+		}
+
+		// Compiler html / jsons
+		s.nbLines += n
+		if s.nbLines > s.compilationTrigger {
+			s.nbLines = 0
+			//Non-blocking
+			if !s.compiling {
+				go func() {
+					if err := s.compile(); err != nil {
+						log.Printf("%v: compilation failed: %v", s.name, err)
+					}
+				}()
+			}
+		}
+	}
+}
+
+// process counts the event of l in b, lines that fail to
+// parse are dead-lettered. It only fails on storage errors
+func (s *CompilerStruct) process(b *Batch, l *inputreader.Line, parse parseFunc) error {
+	line := bytes.TrimSpace(l.Data)
+	if len(line) == 0 {
+		return nil
+	}
+	e, err := parse(line)
+	if err != nil {
+		// A bad line should not stop the analysis
+		return s.deadLetter(l, err)
+	}
+	if e == nil {
+		return nil
+	}
+	if l.Sensor != "" {
+		e.fields["sensor"] = l.Sensor
+	}
+	if l.Source != "" {
+		e.fields["source"] = l.Source
+	}
+	// Lines read from files are dated around the
+	// time of the file, archives being past ones
+	ref := time.Now()
+	if !l.Modified.IsZero() {
+		ref = l.Modified
+	}
+	e.time, err = parseTimestamp(e.timestamp, e.layout, s.opts.Timezones.Location(e.fields), ref)
+	if err != nil {
+		return s.deadLetter(l, err)
+	}
+
+	// Writing the event with its logline, so
+	// that statistics can be recomputed
+	if err := s.storeEvent(b, e, line); err != nil {
+		return err
+	}
+	s.compileStats(b, e.time, e.fields)
+	return nil
+}
+
+// deadLetter sets aside a line that failed to parse
+func (s *CompilerStruct) deadLetter(l *inputreader.Line, err error) error {
+	if s.opts.DeadLetters == nil {
+		log.Printf("%v: dropping line from %v: %v", s.name, l.Source, err)
+		return nil
+	}
+	return s.opts.DeadLetters.Push(DeadLetter{
+		Compiler: s.name,
+		Source:   l.Source,
+		Sensor:   l.Sensor,
+		Time:     time.Now(),
+		Error:    err.Error(),
+		Line:     string(l.Data),
+	})
+}
+
+// compileStats counts an event in b: daily, weekly, monthly, yearly
+// and hourly statistics, heatmaps, and the oldest and newest days
+func (s *CompilerStruct) compileStats(b *Batch, parsedTime time.Time, fields map[string]string) {
+	// Daily
+	dstr := fmt.Sprintf("%v%v%v", parsedTime.Year(), fmt.Sprintf("%02d", int(parsedTime.Month())), fmt.Sprintf("%02d", int(parsedTime.Day())))
+	b.Count(dstr)
+	b.Index(dayIndex, dstr)
+	s.compileStat(b, dstr, "daily", fields)
+	s.compilePairs(b, dstr, fields)
+
+	// Monthly
+	mstr := fmt.Sprintf("%v%v", parsedTime.Year(), fmt.Sprintf("%02d", int(parsedTime.Month())))
+	s.compileStat(b, mstr, "monthly", fields)
+	b.Index(monthIndex, mstr)
+
+	// Weekly, ISO weeks may belong to the previous or next year
+	year, week := parsedTime.ISOWeek()
+	wstr := fmt.Sprintf("%vW%02d", year, week)
+	s.compileStat(b, wstr, "weekly", fields)
+
+	// Yearly
+	ystr := fmt.Sprintf("%v", parsedTime.Year())
+	s.compileStat(b, ystr, "yearly", fields)
+	b.Index(yearIndex, ystr)
+
+	// Hourly
+	s.compileHourly(b, parsedTime, fields)
+
+	// Weekday and hour of day
+	for _, v := range []string{mstr, ystr} {
+		s.compileHeatmap(b, v, parsedTime)
+	}
+}
+
+func (s *CompilerStruct) compileStat(b *Batch, datestr string, mode string, fields map[string]string) {
+	for _, d := range s.dimensions {
+		if d.Optional && fields[d.Key] == "" {
+			continue
+		}
+		key := fmt.Sprintf("%v:stats%v", datestr, d.Key)
+		b.Incr(key, fields[d.Key], time.Time{})
+		b.Add(fmt.Sprintf("%v:distinct%v", datestr, d.Key), fields[d.Key])
+		b.Mark(mode, key)
+	}
+	b.Mark("distinct", datestr)
+}
+
+// compile create json and graphical representation of the results,
+// only the outputs marked as dirty are regenerated
+func (s *CompilerStruct) compile() error {
+	s.mu.Lock()
+	s.compiling = true
+	s.compilegr.Add(1)
+	defer func() {
+		s.compiling = false
+		s.mu.Unlock()
+		// Tell main program we can exit if needed now
+		s.compilegr.Done()
+	}()
+	log.Printf("[+] %v compiling", s.name)
+
+	// Regenerate what changed for each granularity, markers
+	// are kept for the next compilation if anything fails
+	for _, g := range granularities {
+		toupdate, err := s.store.Take(g)
+		if err != nil {
+			return err
+		}
+		for _, v := range toupdate {
+			if err := s.regenerate(g, v); err != nil {
+				return err
+			}
+		}
+		if err := s.store.Clear(g); err != nil {
+			return err
+		}
+	}
+
+	// Get oldest / newest entries
+	newest, err := s.store.Get("newest")
+	if err != nil {
+		return err
+	}
+	oldest, err := s.store.Get("oldest")
+	if err != nil {
+		return err
+	}
+	parsedOldest, _ := time.Parse("20060102", oldest)
+	parsedNewest, _ := time.Parse("20060102", newest)
+	parsedOldestStr := parsedOldest.Format("2006-01-02")
+	parsedNewestStr := parsedNewest.Format("2006-01-02")
+
+	// Years and months for which we have statistics
+	years, err := s.periods(yearIndex)
+	if err != nil {
+		return err
+	}
+	monthList, err := s.periods(monthIndex)
+	if err != nil {
+		return err
+	}
+	months := make(map[string][]string)
+	for _, m := range monthList {
+		months[m[:4]] = append(months[m[:4]], m[4:])
+	}
+
+	// Parse Template
+	t, err := template.ParseFiles(filepath.Join("logcompiler", "html", "statistics.gohtml"))
+	if err != nil {
+		return err
+	}
+
+	// The first dimension is displayed by default
+	defaultType := ""
+	if len(s.dimensions) > 0 {
+		defaultType = "stats" + s.dimensions[0].Key
+	}
+
+	daily := struct {
+		Name        string
+		Title       string
+		Dimensions  []Dimension
+		DefaultType string
+		MinDate     string
+		MaxDate     string
+		CurrentTime string
+	}{
+		Name:        s.name,
+		Title:       s.title + " - daily statistics",
+		Dimensions:  s.dimensions,
+		DefaultType: defaultType,
+		MinDate:     parsedOldestStr,
+		MaxDate:     parsedNewestStr,
+		CurrentTime: parsedNewestStr,
+	}
+
+	oldestYear, oldestWeek := parsedOldest.ISOWeek()
+	newestYear, newestWeek := parsedNewest.ISOWeek()
+	newestWeekStr := fmt.Sprintf("%v-W%02d", newestYear, newestWeek)
+	weekly := struct {
+		Name        string
+		Title       string
+		Dimensions  []Dimension
+		DefaultType string
+		MinWeek     string
+		MaxWeek     string
+		CurrentWeek string
+		CurrentTime string
+	}{
+		Name:        s.name,
+		Title:       s.title + " - weekly statistics",
+		Dimensions:  s.dimensions,
+		DefaultType: defaultType,
+		MinWeek:     fmt.Sprintf("%v-W%02d", oldestYear, oldestWeek),
+		MaxWeek:     newestWeekStr,
+		CurrentWeek: newestWeekStr,
+		CurrentTime: parsedNewestStr,
+	}
+
+	monthly := struct {
+		Name        string
+		Title       string
+		Dimensions  []Dimension
+		DefaultType string
+		MonthList   map[string][]string
+		CurrentTime string
+	}{
+		Name:        s.name,
+		Title:       s.title + " - monthly statistics",
+		Dimensions:  s.dimensions,
+		DefaultType: defaultType,
+		MonthList:   months,
+		CurrentTime: parsedNewestStr,
+	}
+
+	yearly := struct {
+		Name        string
+		Title       string
+		Dimensions  []Dimension
+		DefaultType string
+		YearList    []string
+		CurrentTime string
+	}{
+		Name:        s.name,
+		Title:       s.title + " - yearly statistics",
+		Dimensions:  s.dimensions,
+		DefaultType: defaultType,
+		YearList:    years,
+		CurrentTime: parsedNewestStr,
+	}
+
+	// Create folder to store resulting files
+	if _, err := os.Stat("data"); os.IsNotExist(err) {
+		err := os.Mkdir("data", 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join("data", s.name)); os.IsNotExist(err) {
+		err := os.Mkdir(filepath.Join("data", s.name), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		data interface{}
+	}{
+		{"daily", daily},
+		{"weekly", weekly},
+		{"monthly", monthly},
+		{"yearly", yearly},
+	} {
+		if err := writePage(t, filepath.Join("data", s.name, p.name+"statistics.html"), p.name+"tpl", p.data); err != nil {
+			return err
+		}
+	}
+
+	// Copy js asset file
+	input, err := ioutil.ReadFile(filepath.Join("logcompiler", "html", "load.js"))
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join("data", s.name, "load.js"), input, 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[-] %v compiling finished.", s.name)
+
+	return nil
+}
+
+// writePage writes the page of the template tpl to path,
+// between the header and the footer
+func writePage(t *template.Template, path string, tpl string, data interface{}) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"headertpl", tpl, "footertpl"} {
+		if err := t.ExecuteTemplate(f, name, data); err != nil {
+			f.Close()
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	return f.Close()
+}
+
+func (s *CompilerStruct) csvStats(v string) error {
+	members, err := s.store.Members(v)
+	if err != nil {
+		return err
+	}
+
+	stype := strings.Split(v, ":")
+
+	// Create folder to store data
+	if _, err := os.Stat("data"); os.IsNotExist(err) {
+		err := os.Mkdir("data", 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join("data", s.name)); os.IsNotExist(err) {
+		err := os.Mkdir(filepath.Join("data", s.name), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join("data", s.name, stype[0])); os.IsNotExist(err) {
+		err := os.Mkdir(filepath.Join("data", s.name, stype[0]), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	var file *os.File
+	if file, err = os.Create(filepath.Join("data", s.name, stype[0], fmt.Sprintf("%v.csv", v))); err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	for _, m := range members {
+		fmt.Fprintf(file, "%s, %s\n", m.Name, formatScore(m.Score))
+	}
+
+	return file.Close()
+}
+
+// mispExport pushes the top 100 usernames and sources of the day
+// as MISP authentication-failure-report objects of type mtype
+func (s *CompilerStruct) mispExport(mtype string) error {
+
+	today := time.Now()
+	dstr := fmt.Sprintf("%v%v%v", today.Year(), fmt.Sprintf("%02d", int(today.Month())), fmt.Sprintf("%02d", int(today.Day())))
+
+	topUsername, err := s.store.Top(fmt.Sprintf("%v:statsusername", dstr), 100)
+	if err != nil {
+		return err
+	}
+
+	topSource, err := s.store.Top(fmt.Sprintf("%v:statssrc", dstr), 100)
+	if err != nil {
+		return err
+	}
+
+	mispobject := new(MISP_auth_failure_sshd_username)
+	mispobject.Name = "authentication-failure-report"
+	mispobject.Mtype = mtype
+
+	for _, m := range topUsername {
+		mispobject.Username = m.Name
+		mispobject.Total = formatScore(m.Score)
+		b, err := json.Marshal(mispobject)
+		if err != nil {
+			return err
+		}
+		if err := s.store.Push("authf_object", b); err != nil {
+			return err
+		}
+	}
+
+	mispobject.Username = ""
+
+	for _, m := range topSource {
+		mispobject.Source = m.Name
+		mispobject.Total = formatScore(m.Score)
+		b, err := json.Marshal(mispobject)
+		if err != nil {
+			return err
+		}
+		if err := s.store.Push("authf_object", b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *CompilerStruct) plotStats(v string) error {
+	members, err := s.store.Members(v)
+	if err != nil {
+		return err
+	}
+	// Statistics marked may have been deleted since
+	if len(members) == 0 {
+		return nil
+	}
+
+	stype := strings.Split(v, ":")
+	title := ""
+	for _, d := range s.dimensions {
+		if stype[1] == "stats"+d.Key {
+			title = d.Label
+		}
+	}
+	if title == "" {
+		return errors.New("we should not reach this point, open an issue")
+	}
+
+	p, xsize, err := barChart(members, title)
+	if err != nil {
+		return err
+	}
+
+	// Create folder to store plots
+	if _, err := os.Stat("data"); os.IsNotExist(err) {
+		err := os.Mkdir("data", 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join("data", s.name)); os.IsNotExist(err) {
+		err := os.Mkdir(filepath.Join("data", s.name), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join("data", s.name, stype[0])); os.IsNotExist(err) {
+		err := os.Mkdir(filepath.Join("data", s.name, stype[0]), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := p.Save(15*vg.Centimeter, xsize, filepath.Join("data", s.name, stype[0], fmt.Sprintf("%v.svg", v))); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// barChart plots the members of a sorted set, given in
+// ascending order, and returns the plot with its height
+func barChart(members []Member, title string) (*plot.Plot, vg.Length, error) {
+	// Split keys and values - keep these ordered
+	values := make(plotter.Values, 0, len(members))
+	keys := make([]string, 0, len(members))
+
+	for _, m := range members {
+		keys = append(keys, m.Name)
+		values = append(values, m.Score)
+	}
+
+	p, err := plot.New()
+	if err != nil {
+		return nil, 0, err
+	}
+	p.Title.Text = title
+
+	p.Y.Label.Text = "Count"
+	w := 0.5 * vg.Centimeter
+	bc, err := plotter.NewBarChart(values, w)
+	if err != nil {
+		return nil, 0, err
+	}
+	bc.Horizontal = true
+	bc.LineStyle.Width = vg.Length(0)
+	bc.Color = plotutil.Color(2)
+
+	p.Add(bc)
+	p.NominalY(keys...)
+
+	xsize := 3 + vg.Length(math.Round(float64(len(keys)/2)))
+	return p, xsize * vg.Centimeter, nil
+}
+
+// formatScore formats a score as redis does
+func formatScore(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,119 @@
+package logcompiler
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/D4-project/analyzer-d4-log/inputreader"
+)
+
+func TestWritePage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tpl := template.Must(template.New("").Parse(`{{define "headertpl"}}<h1>{{.Title}}</h1>{{end}}` +
+		`{{define "dailytpl"}}<p>{{.Name}}</p>{{end}}` +
+		`{{define "brokentpl"}}{{.Missing}}{{end}}` +
+		`{{define "footertpl"}}<hr>{{end}}`))
+	data := struct{ Title, Name string }{"sshd", "daily"}
+
+	path := filepath.Join(dir, "dailystatistics.html")
+	if err := ioutil.WriteFile(path, []byte("a longer page left by a previous compilation"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePage(tpl, path, "dailytpl", data); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "<h1>sshd</h1><p>daily</p><hr>" {
+		t.Errorf("page = %q", b)
+	}
+
+	// Errors of any template are returned
+	if err := writePage(tpl, path, "brokentpl", data); err == nil {
+		t.Error("writePage() of a failing template should fail")
+	}
+	if err := writePage(tpl, path, "missingtpl", data); err == nil {
+		t.Error("writePage() of a missing template should fail")
+	}
+	if err := writePage(tpl, filepath.Join(dir, "none", "page.html"), "dailytpl", data); err == nil {
+		t.Error("writePage() in a missing directory should fail")
+	}
+}
+
+// ackReader returns its lines, then io.EOF once, then stop.
+// It records how many lines were read at each ack
+type ackReader struct {
+	lines []string
+	read  int
+	eof   bool
+	stop  error
+	acks  []int
+}
+
+func (r *ackReader) ReadLine() (*inputreader.Line, error) {
+	if len(r.lines) > 0 {
+		l := &inputreader.Line{Data: []byte(r.lines[0])}
+		r.lines = r.lines[1:]
+		r.read++
+		return l, nil
+	}
+	if !r.eof {
+		r.eof = true
+		return nil, io.EOF
+	}
+	return nil, r.stop
+}
+
+func (r *ackReader) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (r *ackReader) Ack() error {
+	r.acks = append(r.acks, r.read)
+	return nil
+}
+
+func (r *ackReader) Blocking() bool {
+	return true
+}
+
+func TestPullAck(t *testing.T) {
+	bs, done := newTestBolt(t, "web")
+	defer done()
+	g := newTestGeneric(t, GenericConfig{
+		Name:            "web",
+		Fields:          map[string]string{"timestamp": "ts", "src": "ip", "username": "user"},
+		TimestampLayout: "2006-01-02 15:04:05",
+	})
+	s := &g.CompilerStruct
+	stop := errors.New("stop")
+	r := &ackReader{
+		lines: []string{
+			`{"ts": "2020-03-01 10:00:00", "ip": "1.2.3.4", "user": "root"}`,
+			`not JSON`,
+			`{"ts": "2020-03-01 11:00:00", "ip": "1.2.3.4", "user": "admin"}`,
+		},
+		stop: stop,
+	}
+	c := make(chan error, 1)
+	s.store, s.reader, s.pullreturn = bs, r, &c
+
+	// The lines, the bad one included, are acknowledged
+	// at once, after their batch is committed
+	s.pull(g.parse)
+	if err := <-c; err != stop {
+		t.Fatalf("pull error = %v, want %v", err, stop)
+	}
+	if want := []int{3}; !reflect.DeepEqual(r.acks, want) {
+		t.Errorf("acks after %v lines, want %v", r.acks, want)
+	}
+	expectTop(t, bs, "20200301:statssrc", Member{"1.2.3.4", 2})
+}
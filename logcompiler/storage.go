@@ -0,0 +1,88 @@
+package logcompiler
+
+import (
+	"time"
+)
+
+type (
+	// Storage keeps what a compiler counts. Statistics are sorted sets
+	// of members and their scores, named <period>:stats<dimension key>,
+	// distinct counts are named <period>:distinct<dimension key>, values
+	// are plain strings. Implementations are safe for concurrent use,
+	// and every compiler has its own Storage
+	Storage interface {
+		// Commit writes the updates of b: its raw events first,
+		// then its statistics, markers, values, oldest and newest
+		// days at once, oldest and newest only ever move outwards
+		Commit(b *Batch) error
+		// Members returns the members of the statistics key,
+		// by ascending score
+		Members(key string) ([]Member, error)
+		// Top returns the n members of the statistics key
+		// with the highest scores, highest first
+		Top(key string, n int) ([]Member, error)
+		// Union sums the statistics keys into dest,
+		// which expires after ttl unless ttl is zero
+		Union(dest string, keys []string, ttl time.Duration) error
+		// Distinct returns the number of distinct members added
+		// to the distinct counts keys, a member added to several
+		// keys is counted once. It may be an estimate
+		Distinct(keys ...string) (int64, error)
+		// Merge sets the distinct count dest to the
+		// union of the distinct counts keys
+		Merge(dest string, keys []string) error
+		// Exists tells whether the statistics key exists
+		Exists(key string) (bool, error)
+		// Get returns the value key, or "" if it does not exist
+		Get(key string) (string, error)
+		// Set sets the value key
+		Set(key string, value string) error
+		// Keys returns the statistics and values matching
+		// the glob pattern
+		Keys(pattern string) ([]string, error)
+		// Remove removes members from the statistics key
+		Remove(key string, members ...string) error
+		// Delete deletes statistics and values
+		Delete(keys ...string) error
+
+		// Take moves the markers of granularity aside and returns them,
+		// along with the ones taken but not cleared before
+		Take(granularity string) ([]string, error)
+		// Clear drops the markers taken
+		Clear(granularity string) error
+		// Marked returns the markers of granularity, taken or not
+		Marked(granularity string) ([]string, error)
+
+		// Replay feeds the raw events of day to f, in the order
+		// they were appended
+		Replay(day string, f func([]byte) error) error
+		// Days returns the days holding raw events
+		Days() ([]string, error)
+		// DeleteDay deletes the raw events of day
+		// and returns how many there were
+		DeleteDay(day string) (int, error)
+
+		// Staging returns the staging namespace of the storage,
+		// where statistics are rebuilt before being swapped in.
+		// It shares the resources of the storage and is not closed
+		Staging() (Storage, error)
+		// Swap replaces the statistics and values matching filter
+		// with the ones of staging matching filter, then drops
+		// staging. It returns the keys swapped in
+		Swap(staging Storage, filter func(key string) bool) ([]string, error)
+
+		// Push appends value to the export list
+		Push(list string, value []byte) error
+		// Flush deletes the statistics, values and
+		// markers, raw events are kept
+		Flush() error
+		// Close releases the storage
+		Close() error
+	}
+
+	// Member is a member of a statistics sorted set
+	Member struct {
+		Name  string  `json:"name"`
+		Score float64 `json:"score"`
+	}
+)
@@ -0,0 +1,150 @@
+package logcompiler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Timezones gives the location of loglines whose timestamps have no
+// timezone, depending on their hostname, sensor or source
+type Timezones struct {
+	def     *time.Location
+	hosts   map[string]*time.Location
+	sensors map[string]*time.Location
+	sources map[string]*time.Location
+}
+
+// Layouts of timestamps holding a date, tried before the
+// layout of a compiler. Those without offset are in the
+// location of the logline
+var isoLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// NewTimezones returns Timezones where every logline is in def
+func NewTimezones(def *time.Location) *Timezones {
+	return &Timezones{
+		def:     def,
+		hosts:   make(map[string]*time.Location),
+		sensors: make(map[string]*time.Location),
+		sources: make(map[string]*time.Location),
+	}
+}
+
+// LoadTimezones reads a timezones configuration file, one
+// "<key> <IANA zone>" per line where key is "default", "host=<hostname>",
+// "sensor=<uuid>" or "source=<name>". Without default, the local
+// timezone is used. A missing file is not an error
+func LoadTimezones(path string) (*Timezones, error) {
+	tz := NewTimezones(time.Local)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return tz, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: should be <key> <zone>", path, n)
+		}
+		loc, err := time.LoadLocation(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, n, err)
+		}
+		kv := strings.SplitN(fields[0], "=", 2)
+		switch {
+		case len(kv) == 1 && kv[0] == "default":
+			tz.def = loc
+		case len(kv) == 2 && kv[0] == "host":
+			tz.hosts[kv[1]] = loc
+		case len(kv) == 2 && kv[0] == "sensor":
+			tz.sensors[kv[1]] = loc
+		case len(kv) == 2 && kv[0] == "source":
+			tz.sources[kv[1]] = loc
+		default:
+			return nil, fmt.Errorf("%v:%v: unknown key %v", path, n, fields[0])
+		}
+	}
+	return tz, scanner.Err()
+}
+
+// Location returns the location of an event from its fields,
+// the hostname comes first, then the sensor, then the source
+func (tz *Timezones) Location(fields map[string]string) *time.Location {
+	if tz == nil {
+		return time.Local
+	}
+	if loc, ok := tz.hosts[fields["host"]]; ok {
+		return loc
+	}
+	if loc, ok := tz.sensors[fields["sensor"]]; ok {
+		return loc
+	}
+	if loc, ok := tz.sources[fields["source"]]; ok {
+		return loc
+	}
+	return tz.def
+}
+
+// parseTimestamp parses a timestamp following layout in loc, RFC 3339
+// and ISO 8601 timestamps are accepted as well. Timestamps without year,
+// as in BSD syslog, get the year that brings them closest to now
+func parseTimestamp(timestamp string, layout string, loc *time.Location, now time.Time) (time.Time, error) {
+	if timestamp == "" {
+		return time.Time{}, fmt.Errorf("missing timestamp")
+	}
+	for _, l := range isoLayouts {
+		if t, err := time.ParseInLocation(l, timestamp, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	// Syslog pads single digit days with a space
+	t, err := time.ParseInLocation(strings.Join(strings.Fields(layout), " "), strings.Join(strings.Fields(timestamp), " "), loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t.Year() != 0 {
+		return t, nil
+	}
+
+	var best time.Time
+	for y := now.Year() - 1; y <= now.Year()+1; y++ {
+		c := time.Date(y, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+		// Feb 29 of non leap years
+		if c.Day() != t.Day() {
+			continue
+		}
+		if best.IsZero() || abs(c.Sub(now)) < abs(best.Sub(now)) {
+			best = c
+		}
+	}
+	if best.IsZero() {
+		return time.Time{}, fmt.Errorf("no year around %v has %q", now.Year(), timestamp)
+	}
+	return best, nil
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,149 @@
+package logcompiler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	paris := time.FixedZone("CET", 3600)
+	now := time.Date(2026, time.January, 3, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		layout    string
+		loc       *time.Location
+		now       time.Time
+		want      time.Time
+		wantErr   bool
+	}{
+		{
+			name:      "BSD in the current year",
+			timestamp: "Jan  2 06:25:44",
+			layout:    "Jan 2 15:04:05",
+			loc:       time.UTC,
+			now:       now,
+			want:      time.Date(2026, time.January, 2, 6, 25, 44, 0, time.UTC),
+		},
+		{
+			name:      "BSD of December processed in January",
+			timestamp: "Dec 31 23:59:59",
+			layout:    "Jan 2 15:04:05",
+			loc:       time.UTC,
+			now:       now,
+			want:      time.Date(2025, time.December, 31, 23, 59, 59, 0, time.UTC),
+		},
+		{
+			name:      "BSD of January processed in December",
+			timestamp: "Jan  1 00:00:01",
+			layout:    "Jan 2 15:04:05",
+			loc:       time.UTC,
+			now:       time.Date(2025, time.December, 31, 23, 0, 0, 0, time.UTC),
+			want:      time.Date(2026, time.January, 1, 0, 0, 1, 0, time.UTC),
+		},
+		{
+			name:      "BSD in the timezone of the logline",
+			timestamp: "Jan 2 06:25:44",
+			layout:    "Jan 2 15:04:05",
+			loc:       paris,
+			now:       now,
+			want:      time.Date(2026, time.January, 2, 5, 25, 44, 0, time.UTC),
+		},
+		{
+			name:      "Feb 29 of the closest leap year",
+			timestamp: "Feb 29 10:00:00",
+			layout:    "Jan 2 15:04:05",
+			loc:       time.UTC,
+			now:       time.Date(2027, time.June, 1, 0, 0, 0, 0, time.UTC),
+			want:      time.Date(2028, time.February, 29, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "Feb 29 with no leap year around",
+			timestamp: "Feb 29 10:00:00",
+			layout:    "Jan 2 15:04:05",
+			loc:       time.UTC,
+			now:       time.Date(2026, time.June, 1, 0, 0, 0, 0, time.UTC),
+			wantErr:   true,
+		},
+		{
+			name:      "layout with year",
+			timestamp: "2019/05/04 10:11:12",
+			layout:    "2006/01/02 15:04:05",
+			loc:       paris,
+			now:       now,
+			want:      time.Date(2019, time.May, 4, 9, 11, 12, 0, time.UTC),
+		},
+		{
+			name:      "RFC 3339 whatever the layout",
+			timestamp: "2020-03-01T10:00:00.123+02:00",
+			layout:    "Jan 2 15:04:05",
+			loc:       time.UTC,
+			now:       now,
+			want:      time.Date(2020, time.March, 1, 8, 0, 0, 123000000, time.UTC),
+		},
+		{
+			name:      "ISO 8601 without offset",
+			timestamp: "2020-03-01 10:00:00",
+			layout:    "Jan 2 15:04:05",
+			loc:       paris,
+			now:       now,
+			want:      time.Date(2020, time.March, 1, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "missing timestamp",
+			layout:  "Jan 2 15:04:05",
+			loc:     time.UTC,
+			now:     now,
+			wantErr: true,
+		},
+		{
+			name:      "not following the layout",
+			timestamp: "yesterday",
+			layout:    "Jan 2 15:04:05",
+			loc:       time.UTC,
+			now:       now,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTimestamp(tt.timestamp, tt.layout, tt.loc, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimestamp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseTimestamp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimezonesLocation(t *testing.T) {
+	def := time.FixedZone("def", 1*3600)
+	host := time.FixedZone("host", 2*3600)
+	sensor := time.FixedZone("sensor", 3*3600)
+	source := time.FixedZone("source", 4*3600)
+	tz := NewTimezones(def)
+	tz.hosts["h"] = host
+	tz.sensors["s"] = sensor
+	tz.sources["q"] = source
+
+	tests := []struct {
+		fields map[string]string
+		want   *time.Location
+	}{
+		{map[string]string{"host": "h", "sensor": "s", "source": "q"}, host},
+		{map[string]string{"host": "other", "sensor": "s", "source": "q"}, sensor},
+		{map[string]string{"source": "q"}, source},
+		{map[string]string{"host": "other"}, def},
+	}
+	for _, tt := range tests {
+		if got := tz.Location(tt.fields); got != tt.want {
+			t.Errorf("Location(%v) = %v, want %v", tt.fields, got, tt.want)
+		}
+	}
+	if got := (*Timezones)(nil).Location(nil); got != time.Local {
+		t.Errorf("Location() without timezones = %v, want Local", got)
+	}
+}
@@ -0,0 +1,42 @@
+package logparser
+
+import (
+	"regexp"
+)
+
+// SSHDFailure is a failed login found in a sshd message
+type SSHDFailure struct {
+	// Username tried, may be empty
+	Username string
+	// ClientIP the attempt came from
+	ClientIP string
+}
+
+// sshdMatchers recognise failed logins in sshd messages. Each attempt
+// is logged several times by sshd, only one message is matched per attempt:
+// "Invalid user" for unknown accounts, "Failed ..." for existing ones.
+var sshdMatchers = []*regexp.Regexp{
+	regexp.MustCompile(`^Invalid user (?P<username>.*?) from (?P<ip>[0-9A-Fa-f.:]+)(?: port \d+)?\s*$`),
+	regexp.MustCompile(`^Failed (?:password|publickey|keyboard-interactive/pam|none) for (?P<username>[^ ]+) from (?P<ip>[0-9A-Fa-f.:]+) port \d+`),
+}
+
+// MatchSSHD returns the failed login found in a sshd message, if any
+func MatchSSHD(message string) (*SSHDFailure, bool) {
+	for _, re := range sshdMatchers {
+		m := re.FindStringSubmatch(message)
+		if m == nil {
+			continue
+		}
+		f := &SSHDFailure{}
+		for i, name := range re.SubexpNames() {
+			switch name {
+			case "username":
+				f.Username = m[i]
+			case "ip":
+				f.ClientIP = m[i]
+			}
+		}
+		return f, true
+	}
+	return nil, false
+}
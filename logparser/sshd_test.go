@@ -0,0 +1,28 @@
+package logparser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchSSHD(t *testing.T) {
+	tests := []struct {
+		message string
+		want    *SSHDFailure
+	}{
+		{"Invalid user admin from 1.2.3.4 port 22", &SSHDFailure{Username: "admin", ClientIP: "1.2.3.4"}},
+		{"Invalid user  from 1.2.3.4", &SSHDFailure{Username: "", ClientIP: "1.2.3.4"}},
+		{"Invalid user oracle test from 2001:db8::1 port 4242", &SSHDFailure{Username: "oracle test", ClientIP: "2001:db8::1"}},
+		{"Failed password for root from 5.6.7.8 port 51234 ssh2", &SSHDFailure{Username: "root", ClientIP: "5.6.7.8"}},
+		{"Failed publickey for git from 5.6.7.8 port 51234 ssh2: RSA SHA256:abc", &SSHDFailure{Username: "git", ClientIP: "5.6.7.8"}},
+		{"Failed password for invalid user admin from 1.2.3.4 port 22 ssh2", nil},
+		{"Accepted publickey for git from 5.6.7.8 port 51234 ssh2", nil},
+		{"Connection closed by 1.2.3.4 port 22 [preauth]", nil},
+	}
+	for _, tt := range tests {
+		got, ok := MatchSSHD(tt.message)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MatchSSHD(%q) = %+v, %v, want %+v", tt.message, got, ok, tt.want)
+		}
+	}
+}
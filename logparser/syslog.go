@@ -0,0 +1,195 @@
+// Package logparser parses raw loglines without relying on
+// an external groker such as NiFi or logstash.
+package logparser
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog is a parsed syslog line, either RFC 3164 (BSD) or RFC 5424
+type Syslog struct {
+	// Priority, -1 when the line does not carry one
+	Priority int
+	// Timestamp as found in the line
+	Timestamp string
+	// Hostname, empty when nil
+	Hostname string
+	// Program, a.k.a. tag or app-name, empty when nil
+	Program string
+	// Pid, a.k.a. procid, empty when nil
+	Pid string
+	// Message, without structured data for RFC 5424
+	Message string
+	// RFC5424 is set when the line follows RFC 5424
+	RFC5424 bool
+}
+
+var (
+	// ErrNotSyslog is returned for lines that do not look like syslog
+	ErrNotSyslog = errors.New("not a syslog line")
+
+	// BSD timestamp layout, the day is space padded
+	bsdLayout = "Jan _2 15:04:05"
+)
+
+// ParseSyslog parses a syslog line. RFC 3164 lines are accepted
+// with or without priority, as written in /var/log by most daemons,
+// and with either a BSD or a RFC 3339 timestamp.
+func ParseSyslog(line []byte) (*Syslog, error) {
+	l := string(bytes.TrimRight(line, "\r\n"))
+	s := &Syslog{Priority: -1}
+
+	// Priority
+	if strings.HasPrefix(l, "<") {
+		end := strings.IndexByte(l, '>')
+		if end < 2 || end > 4 {
+			return nil, ErrNotSyslog
+		}
+		pri, err := strconv.Atoi(l[1:end])
+		if err != nil || pri > 191 {
+			return nil, ErrNotSyslog
+		}
+		s.Priority = pri
+		l = l[end+1:]
+		// RFC 5424 version
+		if strings.HasPrefix(l, "1 ") {
+			s.RFC5424 = true
+			if err := parse5424(s, l[2:]); err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+	}
+
+	if err := parse3164(s, l); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parse3164 parses what follows the priority in a BSD syslog line:
+// TIMESTAMP HOSTNAME TAG[PID]: MSG
+func parse3164(s *Syslog, l string) error {
+	// BSD timestamp has a fixed length, RFC 3339 ends with a space
+	if len(l) >= len(bsdLayout) {
+		if _, err := time.Parse(bsdLayout, l[:len(bsdLayout)]); err == nil {
+			s.Timestamp = l[:len(bsdLayout)]
+			l = l[len(bsdLayout):]
+		}
+	}
+	if s.Timestamp == "" {
+		field, rest := nextField(l)
+		if _, err := time.Parse(time.RFC3339Nano, field); err != nil {
+			return ErrNotSyslog
+		}
+		s.Timestamp = field
+		l = rest
+	}
+	l = strings.TrimLeft(l, " ")
+
+	// Hostname
+	s.Hostname, l = nextField(l)
+	if s.Hostname == "" {
+		return ErrNotSyslog
+	}
+
+	// Tag, ends with ':' or '[pid]:'
+	colon := strings.Index(l, ": ")
+	if colon < 0 {
+		if !strings.HasSuffix(l, ":") {
+			// No tag, everything is the message
+			s.Message = l
+			return nil
+		}
+		colon = len(l) - 1
+	}
+	tag := l[:colon]
+	if strings.ContainsAny(tag, " \t") {
+		s.Message = l
+		return nil
+	}
+	if open := strings.IndexByte(tag, '['); open >= 0 && strings.HasSuffix(tag, "]") {
+		s.Program = tag[:open]
+		s.Pid = tag[open+1 : len(tag)-1]
+	} else {
+		s.Program = tag
+	}
+	if colon+2 <= len(l) {
+		s.Message = l[colon+2:]
+	}
+	return nil
+}
+
+// parse5424 parses what follows the version in a RFC 5424 line:
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parse5424(s *Syslog, l string) error {
+	var fields [5]string
+	for i := range fields {
+		fields[i], l = nextField(l)
+		if fields[i] == "" {
+			return ErrNotSyslog
+		}
+		if fields[i] == "-" {
+			fields[i] = ""
+		}
+	}
+	s.Timestamp = fields[0]
+	s.Hostname = fields[1]
+	s.Program = fields[2]
+	s.Pid = fields[3]
+	if s.Timestamp != "" {
+		if _, err := time.Parse(time.RFC3339Nano, s.Timestamp); err != nil {
+			return ErrNotSyslog
+		}
+	}
+
+	// Structured data is either nil or a list of [elements]
+	if strings.HasPrefix(l, "-") {
+		l = l[1:]
+	} else {
+		for strings.HasPrefix(l, "[") {
+			end := sdElementEnd(l)
+			if end < 0 {
+				return ErrNotSyslog
+			}
+			l = l[end+1:]
+		}
+	}
+	l = strings.TrimPrefix(l, " ")
+	// Messages may start with an UTF-8 BOM
+	s.Message = strings.TrimPrefix(l, "\ufeff")
+	return nil
+}
+
+// sdElementEnd returns the index of the ']' closing the
+// structured data element that starts l, -1 if there is none
+func sdElementEnd(l string) int {
+	quoted := false
+	for i := 1; i < len(l); i++ {
+		switch l[i] {
+		case '\\':
+			// Escaped '"', '\' or ']'
+			i++
+		case '"':
+			quoted = !quoted
+		case ']':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// nextField splits l on its first space
+func nextField(l string) (string, string) {
+	i := strings.IndexByte(l, ' ')
+	if i < 0 {
+		return l, ""
+	}
+	return l[:i], l[i+1:]
+}
@@ -0,0 +1,97 @@
+package logparser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    *Syslog
+		wantErr bool
+	}{
+		{
+			name: "BSD from /var/log",
+			line: "Jan  5 06:25:44 sshd-host sshd[1234]: Invalid user admin from 1.2.3.4 port 22\n",
+			want: &Syslog{Priority: -1, Timestamp: "Jan  5 06:25:44", Hostname: "sshd-host", Program: "sshd", Pid: "1234", Message: "Invalid user admin from 1.2.3.4 port 22"},
+		},
+		{
+			name: "BSD with priority",
+			line: "<38>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			want: &Syslog{Priority: 38, Timestamp: "Oct 11 22:14:15", Hostname: "mymachine", Program: "su", Message: "'su root' failed for lonvick on /dev/pts/8"},
+		},
+		{
+			name: "BSD with RFC 3339 timestamp",
+			line: "2020-03-01T10:00:00.123+01:00 host postfix/smtpd[42]: connect from unknown[5.6.7.8]",
+			want: &Syslog{Priority: -1, Timestamp: "2020-03-01T10:00:00.123+01:00", Hostname: "host", Program: "postfix/smtpd", Pid: "42", Message: "connect from unknown[5.6.7.8]"},
+		},
+		{
+			name: "BSD without tag",
+			line: "Feb 10 01:02:03 host some message without tag",
+			want: &Syslog{Priority: -1, Timestamp: "Feb 10 01:02:03", Hostname: "host", Message: "some message without tag"},
+		},
+		{
+			name: "BSD with empty message",
+			line: "Feb 10 01:02:03 host cron:",
+			want: &Syslog{Priority: -1, Timestamp: "Feb 10 01:02:03", Hostname: "host", Program: "cron"},
+		},
+		{
+			name: "RFC 5424 with structured data",
+			line: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"] An application event`,
+			want: &Syslog{Priority: 165, Timestamp: "2003-10-11T22:14:15.003Z", Hostname: "mymachine.example.com", Program: "evntslog", Message: "An application event", RFC5424: true},
+		},
+		{
+			name: "RFC 5424 with escaped bracket and BOM",
+			line: "<34>1 2003-10-11T22:14:15.003Z host sshd 99 - [a@1 x=\"a\\]b\"][b@1 y=\"]\"] \ufeffhello",
+			want: &Syslog{Priority: 34, Timestamp: "2003-10-11T22:14:15.003Z", Hostname: "host", Program: "sshd", Pid: "99", Message: "hello", RFC5424: true},
+		},
+		{
+			name: "RFC 5424 with nil values",
+			line: "<13>1 - - - - - -",
+			want: &Syslog{Priority: 13, RFC5424: true},
+		},
+		{
+			name:    "RFC 5424 with unterminated structured data",
+			line:    `<13>1 2003-10-11T22:14:15Z host app - - [a@1 x="y"`,
+			wantErr: true,
+		},
+		{
+			name:    "RFC 5424 with invalid timestamp",
+			line:    "<13>1 yesterday host app - - - message",
+			wantErr: true,
+		},
+		{
+			name:    "priority out of range",
+			line:    "<192>Oct 11 22:14:15 host app: message",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated priority",
+			line:    "<13Oct 11 22:14:15 host app: message",
+			wantErr: true,
+		},
+		{
+			name:    "no timestamp",
+			line:    "host app: message",
+			wantErr: true,
+		},
+		{
+			name:    "no hostname",
+			line:    "Oct 11 22:14:15 ",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSyslog([]byte(tt.line))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSyslog() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSyslog() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
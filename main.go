@@ -3,18 +3,24 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/D4-project/analyzer-d4-log/grok"
 	"github.com/D4-project/analyzer-d4-log/inputreader"
 	"github.com/D4-project/analyzer-d4-log/logcompiler"
 	config "github.com/D4-project/d4-golang-utils/config"
 	"github.com/gomodule/redigo/redis"
+	bolt "go.etcd.io/bbolt"
 )
 
 type (
@@ -23,6 +29,17 @@ type (
 		redisHost string
 		redisPort string
 		redisDB   int
+		// Queue or stream, named after the compiler when empty
+		queue string
+		// Redis streams consumer group, the default is to LPOP lists
+		stream    bool
+		group     string
+		consumer  string
+		claimIdle time.Duration
+		// Lists are popped batch elements at a time
+		batch int
+		// How long reads wait for new data
+		block time.Duration
 	}
 	redisconfCompilers struct {
 		redisHost    string
@@ -41,16 +58,32 @@ var (
 	// Flags
 	confdir  = flag.String("c", "conf.sample", "configuration directory")
 	all      = flag.Bool("a", true, "run all compilers when set. Set by default")
-	specific = flag.String("o", "", "run only a specific parser [sshd]")
+	specific = flag.String("o", "", "run only the specified compilers, comma separated [sshd,postfix]")
+	list     = flag.Bool("l", false, "list available compilers, then quits")
 	debug    = flag.Bool("d", false, "debug info in logs")
-	fromfile = flag.String("f", "", "parse from file on disk")
+	fromfile = flag.String("f", "", "parse from files on disk: a file, a glob pattern or a directory, gzip, bzip2 and zstd files are decompressed")
+	follow   = flag.Bool("follow", false, "with -f, follow a single file across rotations and resume from the last checkpoint on restart")
+	raw      = flag.Bool("raw", false, "parse raw syslog loglines instead of groked JSON")
+	groker   = flag.Bool("grok", false, "grok raw loglines with the patterns of the configuration directory")
+	d4       = flag.Bool("d4", false, "register as a d4-server analyzer and consume its type 3 queues")
+	syslog   = flag.Bool("syslog", false, "listen for syslog messages instead of reading redis")
 	retry    = flag.Duration("r", tmpretry, "Time in human format before retrying to read an empty d4 queue")
-	flush    = flag.Bool("F", false, "Flush HTML output, recompile all statistic from redis logs, then quits")
-	// Pools of redis connections
-	redisCompilers *redis.Pool
-	redisInput     *redis.Pool
+	flush    = flag.Bool("F", false, "rebuild the statistics of the selected compilers from their raw events, then quits")
+	fromDay  = flag.String("from", "", "with -F, first day YYYYMMDD to rebuild, whole months and weeks are rebuilt")
+	toDay    = flag.String("to", "", "with -F, last day YYYYMMDD to rebuild")
+	showDead = flag.Bool("deadletters", false, "print the dead letters of the selected compilers as JSON, then quits")
+	reinject = flag.Bool("reinject", false, "push the dead letters of the selected compilers back to their input queue, then quits")
+	httpd    = flag.Bool("http", false, "serve the HTML output and date ranges on the http_server address")
+	status   = flag.Bool("status", false, "print the outputs of the selected compilers waiting to be regenerated, then quits")
+	janitor  = flag.Bool("janitor", false, "delete the data of the selected compilers that left its retention window, print what was reclaimed, then quits")
+	bench    = flag.Int("bench", 0, "store and count this many generated events with the selected compilers on scratch keys, print the events per second, then quits")
+	// Pool of input redis connections
+	redisInput *redis.Pool
+	// Syslog listener
+	syslogServer *inputreader.SyslogServer
+	// Followed files, closed on exit to save their checkpoint
+	tailers []*inputreader.TailReader
 	// Compilers
-	compilers          = [1]string{"sshd"}
 	compilationTrigger = 2000
 	torun              = []logcompiler.Compiler{}
 	// Routine handling
@@ -63,12 +96,17 @@ func main() {
 	pullreturn := make(chan error, 1)
 	// Create a chan to get os Signals
 	sortie := make(chan os.Signal, 1)
-	signal.Notify(sortie, os.Interrupt, os.Kill)
+	signal.Notify(sortie, os.Interrupt, syscall.SIGTERM)
 	// OS signaling and error handling goroutine
 	go func() {
 		select {
 		case <-sortie:
 			fmt.Println("Exiting.")
+			for _, t := range tailers {
+				if err := t.Close(); err != nil {
+					log.Println(err)
+				}
+			}
 			compilegr.Wait()
 			log.Println("Exit")
 			os.Exit(0)
@@ -94,20 +132,33 @@ func main() {
 	flag.Usage = func() {
 		fmt.Printf("analyzer-d4-log:\n\n")
 		fmt.Printf("  Generate statistics about logs collected through d4 in HTML format.\n")
-		fmt.Printf("  Logs should be groked and served as escaped JSON.\n")
+		fmt.Printf("  Logs should be groked and served as escaped JSON,\n")
+		fmt.Printf("  or served as raw loglines with -raw or -grok.\n")
 		fmt.Printf("\n")
 		flag.PrintDefaults()
 		fmt.Printf("\n")
 		fmt.Printf("The configuration directory should hold the following files\n")
 		fmt.Printf("to specify the settings to use:\n\n")
-		fmt.Printf(" mandatory: redis_d4 - host:port/db\n")
-		fmt.Printf(" mandatory: redis_compilers - host:port/maxdb\n")
-		//		fmt.Printf(" optional: http_server - host:port\n\n")
+		fmt.Printf(" mandatory: redis_input - host:port/db[?options], see README\n")
+		fmt.Printf("            options: batch=n&block=duration or mode=stream&group=name&consumer=name&claim=duration&block=duration\n")
+		fmt.Printf(" mandatory: redis_compilers - host:port/maxdb, unless storage is bolt\n")
+		fmt.Printf(" optional: storage - redis (default) or bolt:path, a database file replacing the compilers redis\n")
+		fmt.Printf(" optional: compilers/<name>.json - generic compilers definitions\n")
+		fmt.Printf(" optional: grok/<name> - grok expressions of a compiler, used with -grok\n")
+		fmt.Printf(" optional: grok/patterns/* - custom grok patterns, used with -grok\n")
+		fmt.Printf(" optional: d4/<name> - d4 analyzer uuid of a compiler, generated if missing, used with -d4\n")
+		fmt.Printf(" optional: syslog_udp, syslog_tcp - host:port to listen on, used with -syslog\n")
+		fmt.Printf(" optional: inputs/<name> - name host:port/db[?options] per line, sources of a compiler\n")
+		fmt.Printf(" optional: timezones - <default|host=name|sensor=uuid|source=name> <zone> per line, local time by default\n")
+		fmt.Printf(" optional: retention - <hourly|raw|daily|files> <duration> and archive <directory> per line, hourly statistics are kept 7d and the rest forever by default\n")
+		fmt.Printf(" optional: redis_layout - <raw|stats|misp> <db> and prefix <prefix> per line, databases 0, 1, 3 and no prefix by default\n")
+		fmt.Printf(" optional: deadletter - host:port/db/list or file:path - where lines failing to parse are kept\n")
+		fmt.Printf(" optional: http_server - host:port, used with -http\n")
 		fmt.Printf("See conf.sample for an example.\n")
 	}
 
 	// Config
-	// c := conf{}
+	c := conf{}
 	ri := redisconfInput{}
 	rp := redisconfCompilers{}
 	flag.Parse()
@@ -118,107 +169,294 @@ func main() {
 		*confdir = strings.TrimSuffix(*confdir, "/")
 		*confdir = strings.TrimSuffix(*confdir, "\\")
 	}
+	// Maintenance commands read no input
+	offline := *flush || *status || *janitor || *bench > 0
 
 	// Debug log
 	if *debug {
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 	}
 
-	// Dont't touch input server if Flushing
-	if !*flush {
+	// Register config-driven compilers
+	if err := logcompiler.LoadGenericCompilers(filepath.Join(*confdir, "compilers")); err != nil {
+		log.Fatal(err)
+	}
+
+	// List compilers
+	if *list {
+		for _, v := range logcompiler.Names() {
+			fmt.Printf("%-12s %s\n", v, logcompiler.Description(v))
+		}
+		os.Exit(0)
+	}
+
+	// Select compilers depending on the compiler flags,
+	// -o takes precedence over -a
+	var compilers []string
+	if *specific != "" {
+		for _, v := range strings.Split(*specific, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			if !logcompiler.IsRegistered(v) {
+				log.Fatalf("Unknown compiler %v, use -l to list available compilers", v)
+			}
+			compilers = append(compilers, v)
+		}
+	} else if *all {
+		compilers = logcompiler.Names()
+	}
+	if len(compilers) == 0 {
+		log.Fatal("No compiler selected.")
+	}
+
+	// Dont't touch input server if Flushing, reading files or listening for syslog
+	if !offline && !*syslog && *fromfile == "" {
 		// Parse Input Redis Config
-		tmp := config.ReadConfigFile(*confdir, "redis_input")
+		ri, err = parseRedisInput(readOptionalConfig(*confdir, "redis_input"))
+		if err != nil {
+			log.Fatalf("Redis input config error: %v", err)
+		}
+	}
+
+	// Storage of the compilers, the compilers redis by default
+	storage := readOptionalConfig(*confdir, "storage")
+	var boltDB *bolt.DB
+	if strings.HasPrefix(storage, "bolt:") {
+		boltDB, err = logcompiler.OpenBolt(strings.TrimPrefix(storage, "bolt:"))
+		if err != nil {
+			log.Fatalf("Could not open storage: %v", err)
+		}
+		defer boltDB.Close()
+	} else if storage != "" && storage != "redis" {
+		log.Fatal("Storage config error: should be redis or bolt:path")
+	} else {
+		// Parse Redis Compilers Config
+		tmp := config.ReadConfigFile(*confdir, "redis_compilers")
 		ss := strings.Split(string(tmp), "/")
 		if len(ss) <= 1 {
-			log.Fatal("Missing Database in Redis input config: should be host:port/database_name")
+			log.Fatal("Missing Database Count in Redis config: should be host:port/max number of DB")
 		}
-		ri.redisDB, _ = strconv.Atoi(ss[1])
+		rp.redisDBCount, _ = strconv.Atoi(ss[1])
 		var ret bool
 		ret, ss[0] = config.IsNet(ss[0])
 		if ret {
 			sss := strings.Split(string(ss[0]), ":")
-			ri.redisHost = sss[0]
-			ri.redisPort = sss[1]
+			rp.redisHost = sss[0]
+			rp.redisPort = sss[1]
 		} else {
 			log.Fatal("Redis config error.")
 		}
 	}
 
-	// Parse Redis Compilers Config
-	tmp := config.ReadConfigFile(*confdir, "redis_compilers")
-	ss := strings.Split(string(tmp), "/")
-	if len(ss) <= 1 {
-		log.Fatal("Missing Database Count in Redis config: should be host:port/max number of DB")
+	// Parse HTTP Server Config
+	if *httpd && !offline {
+		tmp := config.ReadConfigFile(*confdir, "http_server")
+		ok, addr := config.IsNet(string(tmp))
+		if !ok {
+			log.Fatal("HTTP server config error: should be host:port")
+		}
+		i := strings.LastIndex(addr, ":")
+		c.httpHost, c.httpPort = addr[:i], addr[i+1:]
 	}
-	rp.redisDBCount, _ = strconv.Atoi(ss[1])
-	var ret bool
-	ret, ss[0] = config.IsNet(ss[0])
-	if ret {
-		sss := strings.Split(string(ss[0]), ":")
-		rp.redisHost = sss[0]
-		rp.redisPort = sss[1]
-	} else {
-		log.Fatal("Redis config error.")
+
+	// Grok patterns library, with custom patterns from the configuration directory
+	var g *grok.Grok
+	if *groker {
+		if *raw {
+			log.Fatal("-raw and -grok are mutually exclusive.")
+		}
+		g = grok.New()
+		if err := g.AddPatternsFromDir(filepath.Join(*confdir, "grok", "patterns")); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// Create a connection Pool for output Redis
-	redisCompilers = newPool(rp.redisHost+":"+rp.redisPort, rp.redisDBCount)
+	// Create a connection Pool for input Redis
 	redisInput = newPool(ri.redisHost+":"+ri.redisPort, 16)
 
-	// Init compiler depending on the compiler flags:
-	if *all {
-		// Init all compilers
+	// Lines failing to parse are kept aside
+	var deadLetters logcompiler.DeadLetters
+	if dl := readOptionalConfig(*confdir, "deadletter"); dl != "" {
+		deadLetters, err = newDeadLetters(dl)
+		if err != nil {
+			log.Fatalf("Dead letter config error: %v", err)
+		}
+	}
+	// Timezones of the loglines
+	timezones, err := logcompiler.LoadTimezones(filepath.Join(*confdir, "timezones"))
+	if err != nil {
+		log.Fatalf("Timezones config error: %v", err)
+	}
+
+	// Retention of the statistics
+	retention, err := logcompiler.LoadRetention(filepath.Join(*confdir, "retention"))
+	if err != nil {
+		log.Fatalf("Retention config error: %v", err)
+	}
+
+	// Databases and key prefix of the compilers
+	layout, err := logcompiler.LoadLayout(filepath.Join(*confdir, "redis_layout"))
+	if err != nil {
+		log.Fatalf("Redis layout config error: %v", err)
+	}
+
+	if *showDead || *reinject {
+		if deadLetters == nil {
+			log.Fatal("No dead letter configuration.")
+		}
 		for _, v := range compilers {
-			switch v {
-			case "sshd":
-				sshdrcon0, err := redisCompilers.Dial()
-				if err != nil {
-					log.Fatal("Could not connect to input line on Compiler Redis")
-				}
-				defer sshdrcon0.Close()
-				sshdrcon1, err := redisCompilers.Dial()
-				if err != nil {
-					log.Fatal("Could not connect to output line on Compiler Redis")
-				}
-				defer sshdrcon1.Close()
-				sshdrcon2, err := redisInput.Dial()
+			if *reinject {
+				err = reinjectDeadLetters(v, ri, deadLetters)
+			} else {
+				err = printDeadLetters(v, deadLetters)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		os.Exit(0)
+	}
+
+	// Syslog listener shared by all compilers
+	if *syslog && !offline {
+		if !*raw && !*groker {
+			log.Fatal("-syslog requires -raw or -grok.")
+		}
+		var err error
+		syslogServer, err = inputreader.NewSyslogServer(readOptionalConfig(*confdir, "syslog_udp"), readOptionalConfig(*confdir, "syslog_tcp"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer syslogServer.Close()
+	}
+
+	// Compilers sharing their keys would overwrite each other's statistics
+	if boltDB == nil && *bench == 0 && len(compilers) > 1 && !strings.Contains(layout.Prefix, "{compiler}") {
+		log.Fatal("Several compilers need {compiler} in their redis_layout prefix, e.g. prefix {compiler}:")
+	}
+
+	// Init selected compilers
+	for _, v := range compilers {
+		c, err := logcompiler.New(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Benchmarks write aside the data of the compiler
+		name, l := v, layout.For(v)
+		if *bench > 0 {
+			name = "bench:" + v
+			l.Prefix = name + ":"
+		}
+		var store logcompiler.Storage
+		if boltDB != nil {
+			store, err = logcompiler.NewBoltStorage(boltDB, name)
+		} else {
+			store, err = logcompiler.NewRedisStorage(rp.redisHost+":"+rp.redisPort, l)
+		}
+		if err != nil {
+			log.Fatalf("Could not open %v storage: %v", v, err)
+		}
+		defer store.Close()
+		// Compiler input, there is none when flushing
+		// and files are opened later on
+		var input io.Reader
+		if !offline && *fromfile == "" {
+			input = newInput(v, ri)
+		}
+		c.Set(&pullgr, store, input, compilationTrigger, &compilegr, &pullreturn, *retry)
+		opts := logcompiler.Options{
+			Raw:         *raw,
+			DeadLetters: deadLetters,
+			Timezones:   timezones,
+			Retention:   retention,
+		}
+		if *groker {
+			opts.Grok, err = g.CompileFile(filepath.Join(*confdir, "grok", v))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if oc, ok := c.(logcompiler.OptionsChecker); ok {
+			if err := oc.CheckOptions(opts); err != nil {
+				log.Fatalf("%v: %v", v, err)
+			}
+		}
+		c.SetOptions(opts)
+		torun = append(torun, c)
+	}
+
+	// Status of the outputs, we bypass the compiling loop
+	if *status {
+		for i, v := range torun {
+			pending, err := v.Pending()
+			if err != nil {
+				log.Fatal(err)
+			}
+			printPending(compilers[i], pending)
+		}
+		os.Exit(0)
+	}
+
+	// Retention, we bypass the compiling loop
+	if *janitor {
+		for i, v := range torun {
+			rc, err := v.Janitor()
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%v: reclaimed %v\n", compilers[i], rc)
+		}
+		os.Exit(0)
+	}
+
+	// Throughput of the storage, one event per commit as with
+	// acknowledged inputs, then in batches as with files and -F
+	if *bench > 0 {
+		for i, v := range torun {
+			for _, batch := range []int{1, 200, 1000} {
+				rate, err := v.Bench(*bench, batch)
 				if err != nil {
-					log.Fatal("Could not connect to output line on Input Redis")
+					log.Fatal(err)
 				}
-				defer sshdrcon2.Close()
-				redisReader := inputreader.NewLPOPReader(&sshdrcon2, ri.redisDB, "sshd")
-				sshd := logcompiler.SSHDCompiler{}
-				sshd.Set(&pullgr, &sshdrcon0, &sshdrcon1, redisReader, compilationTrigger, &compilegr, &pullreturn, *retry)
-				torun = append(torun, &sshd)
+				fmt.Printf("%v: %v events, %v per commit: %.0f events/s\n", compilers[i], *bench, batch, rate)
 			}
 		}
-	} else if *specific != "" {
-		log.Println("TODO should run specific compiler here")
+		os.Exit(0)
 	}
 
 	// If we flush, we bypass the compiling loop
 	if *flush {
 		for _, v := range torun {
-			err := v.Flush()
-			if err != nil {
+			if err := v.Flush(*fromDay, *toDay, os.Stdout); err != nil {
 				log.Fatal(err)
 			}
-			log.Println("Exit")
-			os.Exit(0)
 		}
+		log.Println("Exit")
+		os.Exit(0)
 	}
 
 	// Launching Pull routines
-	for _, v := range torun {
+	for i, v := range torun {
 
-		// If we read from a file, we set the reader to os.open
-		if *fromfile != "" {
-			f, err = os.Open(*fromfile)
+		// If we follow a file, each compiler has its own checkpoint
+		if *fromfile != "" && *follow {
+			t, err := inputreader.NewTailReader(*fromfile, fmt.Sprintf("analyzer-d4-log.%v.checkpoint", compilers[i]))
 			if err != nil {
-				log.Fatalf("Error opening seed file: %v", err)
+				log.Fatalf("Error opening followed file: %v", err)
 			}
-			defer f.Close()
-			v.SetReader(f)
+			tailers = append(tailers, t)
+			v.SetReader(t)
+		} else if *fromfile != "" {
+			// If we read from files, archives are decompressed
+			// and read oldest first
+			fr, err := inputreader.NewFilesReader(*fromfile)
+			if err != nil {
+				log.Fatalf("Error opening seed files: %v", err)
+			}
+			defer fr.Close()
+			v.SetReader(fr)
 		}
 
 		// we add pulling routines to a waitgroup,
@@ -227,15 +465,45 @@ func main() {
 		go v.Pull(pullreturn)
 	}
 
+	// Serving the HTML output and date ranges
+	if *httpd {
+		named := make(map[string]logcompiler.Compiler)
+		for i, v := range torun {
+			named[compilers[i]] = v
+		}
+		serveHTTP(c.httpHost+":"+c.httpPort, named)
+	}
+
+	// Syslog messages are dispatched once every compiler has its reader
+	if syslogServer != nil {
+		syslogServer.Serve()
+	}
+
+	// Launching janitor routines, hourly
+	// they can immediately die when exiting.
+	for i, v := range torun {
+		go func(name string, v logcompiler.Compiler) {
+			for {
+				rc, err := v.Janitor()
+				if err != nil {
+					log.Printf("%v: janitor failed: %v", name, err)
+				} else {
+					log.Printf("%v: janitor reclaimed %v", name, rc)
+				}
+				time.Sleep(time.Hour)
+			}
+		}(compilers[i], v)
+	}
+
 	// Launching MISP export routines
 	// they can immediately die when exiting.
 	for _, v := range torun {
-		go func() {
+		go func(v logcompiler.Compiler) {
 			ticker := time.NewTicker(24 * time.Hour)
-			for _ = range ticker.C {
+			for range ticker.C {
 				v.MISPexport()
 			}
-		}()
+		}(v)
 	}
 
 	pullgr.Wait()
@@ -251,3 +519,24 @@ func newPool(addr string, maxconn int) *redis.Pool {
 		Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
 	}
 }
+
+// printPending prints the outputs of a compiler waiting
+// to be regenerated, by granularity
+func printPending(name string, pending map[string][]string) {
+	if len(pending) == 0 {
+		fmt.Printf("%v: up to date\n", name)
+		return
+	}
+	fmt.Printf("%v:\n", name)
+	granularities := make([]string, 0, len(pending))
+	for g := range pending {
+		granularities = append(granularities, g)
+	}
+	sort.Strings(granularities)
+	for _, g := range granularities {
+		fmt.Printf("  %v: %v pending\n", g, len(pending[g]))
+		for _, v := range pending[g] {
+			fmt.Printf("    %v\n", v)
+		}
+	}
+}